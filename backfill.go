@@ -0,0 +1,211 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// frames per backfill uplink when REPORT_BATCH_MAX_FRAMES leaves batches unbounded
+const defaultBackfillBatchFrames = 500
+
+// BackfillRequest selects the history a backfill generates
+type BackfillRequest struct {
+	ControllerId     int16    // ControllerMaster.Id
+	ObjectIds        []uint32 // empty means every object of the controller
+	From             time.Time
+	To               time.Time
+	UplinksPerSecond float64
+}
+
+// newBackfillRequest builds a request from the -backfill-* command line flags
+func newBackfillRequest(controllerId int, objectIds string, from string, to string, uplinksPerSecond float64) (BackfillRequest, error) {
+	request := BackfillRequest{ControllerId: int16(controllerId), UplinksPerSecond: uplinksPerSecond}
+	if controllerId <= 0 {
+		return request, fmt.Errorf("-backfill-controller is required")
+	}
+	if uplinksPerSecond <= 0 {
+		return request, fmt.Errorf("-backfill-rate must be positive, got %v", uplinksPerSecond)
+	}
+	for _, raw := range strings.Split(objectIds, ",") {
+		if raw = strings.TrimSpace(raw); raw == "" {
+			continue
+		}
+		objectId, err := strconv.ParseUint(raw, 10, 32)
+		if err != nil {
+			return request, fmt.Errorf("invalid object id %q: %w", raw, err)
+		}
+		request.ObjectIds = append(request.ObjectIds, uint32(objectId))
+	}
+
+	var err error
+	if request.From, err = time.Parse(time.RFC3339, from); err != nil {
+		return request, fmt.Errorf("invalid -backfill-from: %w", err)
+	}
+	if to != "" {
+		if request.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return request, fmt.Errorf("invalid -backfill-to: %w", err)
+		}
+	}
+	return request, nil
+}
+
+// RunBackfill generates the reports the configured generators would have produced
+// between From and To, stamped with their historical times, and sends them through
+// the report batcher no faster than UplinksPerSecond. A failed or rate limited
+// uplink pauses the backfill until the outbox has drained. When the range reaches
+// the present, the last values are saved so live reports continue the series,
+// unless the seed is fixed.
+func (appConfig AppConfig) RunBackfill(ctx context.Context, request BackfillRequest, db *gorm.DB) error {
+	if request.To.IsZero() {
+		request.To = appConfig.clock().Now()
+	}
+	if !request.From.Before(request.To) {
+		return fmt.Errorf("backfill range is empty: %s to %s", request.From.Format(time.RFC3339), request.To.Format(time.RFC3339))
+	}
+
+	var controller ControllerMaster
+	if err := db.First(&controller, request.ControllerId).Error; err != nil {
+		return fmt.Errorf("controller %d: %w", request.ControllerId, err)
+	}
+	appConfig.performAuthOperationIfRequired(ctx, controller, db)
+	if err := db.First(&controller, request.ControllerId).Error; err != nil {
+		return fmt.Errorf("controller %d: %w", request.ControllerId, err)
+	}
+	if controller.Token == "" {
+		return fmt.Errorf("controller %s could not log in", controller.MacAddress)
+	}
+	// The backfill process has not rebooted the controller, its uplinks must not say so
+	generation, _ := rebootStatus(controller)
+	markSynced(controller, generation)
+
+	var objects []WiredDeviceObject
+	query := db.Where("controller_id = ?", controller.ControllerId)
+	if len(request.ObjectIds) > 0 {
+		query = query.Where("object_id IN ?", request.ObjectIds)
+	}
+	if err := query.Find(&objects).Error; err != nil {
+		return fmt.Errorf("failed to fetch wired device objects: %w", err)
+	}
+	// Derived objects need their inputs running live, they are not backfilled
+	generated := objects[:0]
+	for _, object := range objects {
+		if object.Expression == "" {
+			generated = append(generated, object)
+		}
+	}
+	objects = generated
+	if len(objects) == 0 {
+		return fmt.Errorf("no objects to backfill for controller %s", controller.MacAddress)
+	}
+
+	log.WithFields(logrus.Fields{
+		"controller": controller.MacAddress,
+		"objects":    len(objects),
+		"from":       request.From.Format(time.RFC3339),
+		"to":         request.To.Format(time.RFC3339),
+	}).Info("Starting backfill")
+
+	// The report schedule is replayed from From on its own heap, one slot at a time in time order
+	var queue scheduleHeap
+	lives := make([]*liveObject, 0, len(objects))
+	for _, object := range objects {
+		live := &liveObject{object: object, rng: objectRand(object.ControllerId, object.ObjectId)}
+		lives = append(lives, live)
+		key := objectKey{object.ControllerId, object.ObjectId}
+		interval := reportInterval(object)
+		heap.Push(&queue, &scheduledObject{live: live, key: key, interval: interval, nextDue: request.From.Add(spreadOffset(key, interval))})
+	}
+
+	batchFrames := appConfig.ReportBatchMaxFrames
+	if batchFrames <= 0 {
+		batchFrames = defaultBackfillBatchFrames
+	}
+	batcher := appConfig.NewReportBatcher(controller, db)
+	throttle := time.NewTicker(time.Duration(float64(time.Second) / request.UplinksPerSecond))
+	defer throttle.Stop()
+
+	frames, total := 0, 0
+	for len(queue) > 0 {
+		entry := heap.Pop(&queue).(*scheduledObject)
+		if entry.nextDue.After(request.To) {
+			continue
+		}
+
+		object, sendReport := entry.live.advance(entry.nextDue)
+		if sendReport {
+			frames += queueReport(batcher, entry.live, object, entry.nextDue)
+		}
+		entry.nextDue = entry.nextDue.Add(entry.interval)
+		heap.Push(&queue, entry)
+
+		if frames >= batchFrames {
+			if err := appConfig.sendBackfillBatch(ctx, batcher, throttle, db); err != nil {
+				return err
+			}
+			total += frames
+			frames = 0
+			log.WithFields(logrus.Fields{"frames": total, "reached": entry.nextDue.Format(time.RFC3339)}).Info("Backfill progress")
+		}
+	}
+	if frames > 0 {
+		if err := appConfig.sendBackfillBatch(ctx, batcher, throttle, db); err != nil {
+			return err
+		}
+		total += frames
+	}
+
+	for _, live := range lives {
+		if !appConfig.savesGeneratedValues() {
+			break
+		}
+		if request.To.Before(appConfig.clock().Now().Add(-reportInterval(live.object))) {
+			continue
+		}
+		if err := db.Model(&WiredDeviceObject{}).Where("id = ?", live.object.Id).UpdateColumns(map[string]interface{}{
+			"report_value":      live.object.ReportValue,
+			"accumulated_value": live.object.AccumulatedValue,
+		}).Error; err != nil {
+			log.WithError(err).WithField("ObjectName", live.object.ObjectName).Error("Failed to save backfilled value")
+		}
+	}
+
+	log.WithFields(logrus.Fields{"controller": controller.MacAddress, "frames": total}).Info("Backfill completed")
+	return nil
+}
+
+// sendBackfillBatch sends the batched frames once the throttle allows and then
+// waits for the outbox to empty, so the backfill never runs ahead of the server
+func (appConfig AppConfig) sendBackfillBatch(ctx context.Context, batcher *ReportBatcher, throttle *time.Ticker, db *gorm.DB) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-throttle.C:
+	}
+
+	controller := batcher.Controller()
+	err := batcher.Flush()
+	for err != nil || appConfig.hasOutboxBacklog(controller, db) {
+		wait := max(appConfig.OutboxRetryInterval, time.Second)
+		var limited *rateLimitError
+		if errors.As(err, &limited) && limited.retryAfter > 0 {
+			wait = limited.retryAfter
+		}
+		log.WithError(err).WithField("retryIn", wait).Warn("Backfill uplink not delivered, waiting for the outbox to drain")
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		err = appConfig.flushOutbox(controller, db)
+	}
+	return nil
+}
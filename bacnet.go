@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// BACnet application tag numbers, sent in TAG 2 to describe the report value
+const (
+	BacnetNull        = 0
+	BacnetBoolean     = 1
+	BacnetUnsigned    = 2
+	BacnetSigned      = 3
+	BacnetReal        = 4
+	BacnetDouble      = 5
+	BacnetOctetString = 6
+	BacnetCharString  = 7
+	BacnetBitString   = 8
+	BacnetEnumerated  = 9
+	BacnetDate        = 10
+	BacnetTime        = 11
+)
+
+// BACnet wildcard for an unspecified date/time octet
+const bacnetUnspecified = 0xFF
+
+// Add a 1-byte boolean value (0 = false, 1 = true)
+func (t *TagVO) AddBooleanValue(tag int, value bool) {
+	var b byte
+	if value {
+		b = 1
+	}
+	t.AddByteValue(tag, b)
+}
+
+// Add a 4-byte unsigned value (BigEndian)
+func (t *TagVO) AddUnsignedValue(tag int, value uint32) {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, value)
+	t.message = append(t.message, TagValue{
+		Tag:   byte(tag),
+		Value: buf,
+	})
+}
+
+// Add a 4-byte enumerated value (BigEndian), e.g. a multistate present value
+func (t *TagVO) AddEnumeratedValue(tag int, value uint32) {
+	t.AddUnsignedValue(tag, value)
+}
+
+// Add an 8-byte IEEE-754 double value (BigEndian)
+func (t *TagVO) AddDoubleValue(tag int, value float64) {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, math.Float64bits(value))
+	t.message = append(t.message, TagValue{
+		Tag:   byte(tag),
+		Value: buf,
+	})
+}
+
+// Add a bit string encoded the BACnet way: one byte of unused trailing bits, then the bits MSB first
+func (t *TagVO) AddBitStringValue(tag int, bits []bool) {
+	buf := make([]byte, 1+(len(bits)+7)/8)
+	buf[0] = byte((8 - len(bits)%8) % 8)
+	for i, bit := range bits {
+		if bit {
+			buf[1+i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	t.message = append(t.message, TagValue{
+		Tag:   byte(tag),
+		Value: buf,
+	})
+}
+
+// Add a 4-byte BACnet date: year-1900, month, day, day of week (1 = Monday)
+func (t *TagVO) AddDateValue(tag int, value time.Time) {
+	weekday := byte(value.Weekday())
+	if weekday == 0 {
+		weekday = 7
+	}
+	buf := []byte{
+		bacnetUnspecified,
+		byte(value.Month()),
+		byte(value.Day()),
+		weekday,
+	}
+	if year := value.Year() - 1900; year >= 0 && year < bacnetUnspecified {
+		buf[0] = byte(year)
+	}
+	t.message = append(t.message, TagValue{
+		Tag:   byte(tag),
+		Value: buf,
+	})
+}
+
+// Add a 4-byte BACnet time: hour, minute, second, hundredths
+func (t *TagVO) AddTimeValue(tag int, value time.Time) {
+	buf := []byte{
+		byte(value.Hour()),
+		byte(value.Minute()),
+		byte(value.Second()),
+		byte(value.Nanosecond() / int(10*time.Millisecond)),
+	}
+	t.message = append(t.message, TagValue{
+		Tag:   byte(tag),
+		Value: buf,
+	})
+}
+
+// Get a 1-byte boolean value
+func (t *TagVO) GetBooleanValue(tag int) (bool, error) {
+	val, err := t.GetByteValue(tag)
+	if err != nil {
+		return false, err
+	}
+	return val != 0, nil
+}
+
+// Get a 4-byte unsigned value (BigEndian)
+func (t *TagVO) GetUnsignedValue(tag int) (uint32, error) {
+	val, err := t.lookupSized(tag, 4, "unsigned")
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(val), nil
+}
+
+// Get a 4-byte enumerated value (BigEndian)
+func (t *TagVO) GetEnumeratedValue(tag int) (uint32, error) {
+	return t.GetUnsignedValue(tag)
+}
+
+// Get an 8-byte IEEE-754 double value (BigEndian)
+func (t *TagVO) GetDoubleValue(tag int) (float64, error) {
+	val, err := t.lookupSized(tag, 8, "double")
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(val)), nil
+}
+
+// Get a BACnet bit string
+func (t *TagVO) GetBitStringValue(tag int) ([]bool, error) {
+	tv, ok := t.Lookup(tag)
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrTagNotFound, tag)
+	}
+	if len(tv.Value) == 0 || tv.Value[0] > 7 || (len(tv.Value) == 1 && tv.Value[0] != 0) {
+		return nil, fmt.Errorf("%w: tag %d is not a valid bit string", ErrTagTypeMismatch, tag)
+	}
+	count := (len(tv.Value)-1)*8 - int(tv.Value[0])
+	bits := make([]bool, count)
+	for i := range bits {
+		bits[i] = tv.Value[1+i/8]&(0x80>>(i%8)) != 0
+	}
+	return bits, nil
+}
+
+// Get a 4-byte BACnet date, in the given location
+func (t *TagVO) GetDateValue(tag int, loc *time.Location) (time.Time, error) {
+	val, err := t.lookupSized(tag, 4, "date")
+	if err != nil {
+		return time.Time{}, err
+	}
+	if val[0] == bacnetUnspecified || val[1] == bacnetUnspecified || val[2] == bacnetUnspecified {
+		return time.Time{}, fmt.Errorf("%w: tag %d holds a wildcard date", ErrTagTypeMismatch, tag)
+	}
+	return time.Date(1900+int(val[0]), time.Month(val[1]), int(val[2]), 0, 0, 0, 0, loc), nil
+}
+
+// Get a 4-byte BACnet time as the offset from midnight
+func (t *TagVO) GetTimeValue(tag int) (time.Duration, error) {
+	val, err := t.lookupSized(tag, 4, "time")
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(val[0])*time.Hour +
+		time.Duration(val[1])*time.Minute +
+		time.Duration(val[2])*time.Second +
+		time.Duration(val[3])*10*time.Millisecond, nil
+}
+
+// statusFlags expands the low 4 bits of a value into BACnet StatusFlags:
+// in-alarm, fault, overridden, out-of-service
+func statusFlags(value uint32) []bool {
+	return []bool{
+		value&0x1 != 0,
+		value&0x2 != 0,
+		value&0x4 != 0,
+		value&0x8 != 0,
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// ReportBatcher collects report frames for one controller and sends them
+// as a single from-controller uplink once per window, with the frames for
+// each reportFor concatenated back to back. Batches that cannot be delivered
+// go to the outbox and are replayed before anything newer.
+type ReportBatcher struct {
+	appConfig AppConfig
+	db        *gorm.DB
+	window    time.Duration
+	maxFrames int
+
+	mu         sync.Mutex
+	controller ControllerMaster
+	pending    map[int][]byte
+	frames     int
+	full       chan struct{}
+	lastReplay time.Time
+}
+
+func (appConfig AppConfig) NewReportBatcher(controller ControllerMaster, db *gorm.DB) *ReportBatcher {
+	return &ReportBatcher{
+		appConfig:  appConfig,
+		controller: controller,
+		db:         db,
+		window:     appConfig.ReportBatchWindow,
+		maxFrames:  appConfig.ReportBatchMaxFrames,
+		pending:    make(map[int][]byte),
+		full:       make(chan struct{}, 1),
+	}
+}
+
+// Controller returns the latest known record of the batcher's controller
+func (b *ReportBatcher) Controller() ControllerMaster {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.controller
+}
+
+// SetController refreshes the controller record, e.g. after the token changed
+func (b *ReportBatcher) SetController(controller ControllerMaster) {
+	b.mu.Lock()
+	b.controller = controller
+	b.mu.Unlock()
+}
+
+// Add queues a frame for the next uplink, flushing early once the batch is full
+func (b *ReportBatcher) Add(reportFor int, frame []byte) {
+	b.mu.Lock()
+	b.pending[reportFor] = append(b.pending[reportFor], frame...)
+	b.frames++
+	isFull := b.maxFrames > 0 && b.frames >= b.maxFrames
+	b.mu.Unlock()
+
+	if isFull {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run flushes the batch every window until ctx is cancelled.
+// The final flush on shutdown is left to the caller, once no more frames can arrive.
+func (b *ReportBatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(b.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.full:
+		case <-ctx.Done():
+			return
+		}
+		if err := b.Flush(); err != nil {
+			log.WithError(err).WithField("controller", b.Controller().MacAddress).Error("Failed to send report batch")
+		}
+	}
+}
+
+// Flush sends everything collected so far in one uplink and retries the outbox when due
+func (b *ReportBatcher) Flush() error {
+	b.mu.Lock()
+	controller := b.controller
+	pending, frames := b.pending, b.frames
+	b.pending = make(map[int][]byte)
+	b.frames = 0
+	b.mu.Unlock()
+
+	var hasBacklog bool
+	if frames > 0 {
+		// Queued behind any backlog so frames are delivered in order
+		log.WithFields(logrus.Fields{"controller": controller.MacAddress, "frames": frames}).Info("Sending report batch")
+		queued, err := b.appConfig.sendInOrder(controller, pending, b.db)
+		if err != nil {
+			if !queued {
+				b.mu.Lock()
+				b.lastReplay = time.Now()
+				b.mu.Unlock()
+			}
+			return err
+		}
+		hasBacklog = queued
+	} else {
+		hasBacklog = b.appConfig.hasOutboxBacklog(controller, b.db)
+	}
+
+	if !hasBacklog {
+		return nil
+	}
+
+	b.mu.Lock()
+	due := time.Since(b.lastReplay) >= b.appConfig.OutboxRetryInterval
+	if due {
+		b.lastReplay = time.Now()
+	}
+	b.mu.Unlock()
+
+	if !due {
+		return nil
+	}
+	return b.appConfig.flushOutbox(controller, b.db)
+}
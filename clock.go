@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Clock is the time source of the simulation. Report slots, generated values,
+// timestamps, heartbeat freshness, auth retries and the reconcile loop read it,
+// so a run can go faster than real time or be stepped by hand. Pacing towards
+// the server (batch windows, outbox retries, backfill throttling, HTTP and
+// shutdown timeouts) stays on the wall clock because a real server sees it.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer mirrors time.Timer; the time received from C is not meaningful, read Now instead
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Ticker mirrors time.Ticker; the time received from C is not meaningful, read Now instead
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// clock returns the configured clock, the wall clock when none is set
+func (appConfig AppConfig) clock() Clock {
+	if appConfig.Clock == nil {
+		return RealClock{}
+	}
+	return appConfig.Clock
+}
+
+// sleepContext waits d on the clock and reports false when ctx ends first
+func sleepContext(ctx context.Context, clock Clock, d time.Duration) bool {
+	timer := clock.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C():
+		return true
+	}
+}
+
+// RealClock is the wall clock
+type RealClock struct{}
+
+func (RealClock) Now() time.Time                   { return time.Now() }
+func (RealClock) Sleep(d time.Duration)            { time.Sleep(d) }
+func (RealClock) NewTimer(d time.Duration) Timer   { return realTimer{time.NewTimer(d)} }
+func (RealClock) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+type realTimer struct{ timer *time.Timer }
+
+func (t realTimer) C() <-chan time.Time        { return t.timer.C }
+func (t realTimer) Stop() bool                 { return t.timer.Stop() }
+func (t realTimer) Reset(d time.Duration) bool { return t.timer.Reset(d) }
+
+type realTicker struct{ ticker *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.ticker.C }
+func (t realTicker) Stop()               { t.ticker.Stop() }
+
+// AcceleratedClock starts at a chosen instant and runs Speed times faster than the wall clock
+type AcceleratedClock struct {
+	start time.Time
+	epoch time.Time
+	speed float64
+}
+
+func NewAcceleratedClock(start time.Time, speed float64) *AcceleratedClock {
+	return &AcceleratedClock{start: start, epoch: time.Now(), speed: speed}
+}
+
+func (c *AcceleratedClock) Now() time.Time {
+	return c.start.Add(time.Duration(float64(time.Since(c.epoch)) * c.speed))
+}
+
+// real converts a simulated duration to wall clock time
+func (c *AcceleratedClock) real(d time.Duration) time.Duration {
+	return time.Duration(float64(d) / c.speed)
+}
+
+func (c *AcceleratedClock) Sleep(d time.Duration) { time.Sleep(c.real(d)) }
+
+func (c *AcceleratedClock) NewTimer(d time.Duration) Timer {
+	return acceleratedTimer{realTimer{time.NewTimer(c.real(d))}, c}
+}
+
+func (c *AcceleratedClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(max(c.real(d), time.Nanosecond))}
+}
+
+type acceleratedTimer struct {
+	realTimer
+	clock *AcceleratedClock
+}
+
+func (t acceleratedTimer) Reset(d time.Duration) bool { return t.timer.Reset(t.clock.real(d)) }
+
+// ManualClock only moves when Advance is called, firing the timers and tickers that fall due
+type ManualClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*manualTimer
+}
+
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d. Like time.Ticker, a ticker that fell due
+// several times delivers one tick.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+
+	active := c.waiters[:0]
+	for _, waiter := range c.waiters {
+		if waiter.due.After(c.now) {
+			active = append(active, waiter)
+			continue
+		}
+		select {
+		case waiter.c <- c.now:
+		default:
+		}
+		if waiter.period > 0 {
+			for !waiter.due.After(c.now) {
+				waiter.due = waiter.due.Add(waiter.period)
+			}
+			active = append(active, waiter)
+		}
+	}
+	c.waiters = active
+}
+
+// Sleep blocks until the clock has been advanced by d
+func (c *ManualClock) Sleep(d time.Duration) {
+	<-c.NewTimer(d).C()
+}
+
+func (c *ManualClock) NewTimer(d time.Duration) Timer {
+	t := &manualTimer{clock: c, c: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+func (c *ManualClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for ManualClock.NewTicker")
+	}
+	t := &manualTimer{clock: c, c: make(chan time.Time, 1), period: d}
+	t.Reset(d)
+	return manualTicker{t}
+}
+
+type manualTicker struct{ *manualTimer }
+
+func (t manualTicker) Stop() { t.manualTimer.Stop() }
+
+// manualTimer is a timer, or a ticker when period is set, of a ManualClock
+type manualTimer struct {
+	clock  *ManualClock
+	c      chan time.Time
+	due    time.Time
+	period time.Duration
+}
+
+func (t *manualTimer) C() <-chan time.Time { return t.c }
+
+// Stop unschedules the timer and, as with timers since Go 1.23, discards an undelivered tick
+func (t *manualTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	return t.stopLocked()
+}
+
+func (t *manualTimer) stopLocked() bool {
+	select {
+	case <-t.c:
+	default:
+	}
+	for i, waiter := range t.clock.waiters {
+		if waiter == t {
+			t.clock.waiters = append(t.clock.waiters[:i], t.clock.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (t *manualTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	wasActive := t.stopLocked()
+	t.due = t.clock.now.Add(d)
+	if d <= 0 && t.period == 0 {
+		t.c <- t.clock.now
+		return wasActive
+	}
+	t.clock.waiters = append(t.clock.waiters, t)
+	return wasActive
+}
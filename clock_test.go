@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+var testEpoch = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func fired(c <-chan time.Time) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestManualClockTimer(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		advance []time.Duration
+		want    bool
+	}{
+		{"not yet due", 10 * time.Second, []time.Duration{9 * time.Second}, false},
+		{"due exactly", 10 * time.Second, []time.Duration{10 * time.Second}, true},
+		{"due over several steps", 10 * time.Second, []time.Duration{4 * time.Second, 4 * time.Second, 4 * time.Second}, true},
+		{"zero fires at once", 0, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := NewManualClock(testEpoch)
+			timer := clock.NewTimer(tt.timeout)
+			for _, d := range tt.advance {
+				clock.Advance(d)
+			}
+			if got := fired(timer.C()); got != tt.want {
+				t.Errorf("fired = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestManualClockTimerStopAndReset(t *testing.T) {
+	clock := NewManualClock(testEpoch)
+	timer := clock.NewTimer(time.Second)
+	if !timer.Stop() {
+		t.Fatal("Stop of a pending timer = false, want true")
+	}
+	clock.Advance(time.Minute)
+	if fired(timer.C()) {
+		t.Fatal("stopped timer fired")
+	}
+
+	timer.Reset(5 * time.Second)
+	clock.Advance(4 * time.Second)
+	if fired(timer.C()) {
+		t.Fatal("reset timer fired early")
+	}
+	clock.Advance(time.Second)
+	if !fired(timer.C()) {
+		t.Fatal("reset timer did not fire")
+	}
+}
+
+func TestManualClockTicker(t *testing.T) {
+	clock := NewManualClock(testEpoch)
+	ticker := clock.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	// Like time.Ticker, several missed periods deliver a single tick
+	clock.Advance(35 * time.Second)
+	if !fired(ticker.C()) {
+		t.Fatal("ticker did not tick")
+	}
+	if fired(ticker.C()) {
+		t.Fatal("ticker delivered more than one tick")
+	}
+	clock.Advance(4 * time.Second)
+	if fired(ticker.C()) {
+		t.Fatal("ticker ticked before its next period")
+	}
+	clock.Advance(time.Second)
+	if !fired(ticker.C()) {
+		t.Fatal("ticker did not tick on its next period")
+	}
+}
+
+func TestSleepContext(t *testing.T) {
+	clock := NewManualClock(testEpoch)
+
+	done := make(chan bool)
+	go func() { done <- sleepContext(context.Background(), clock, time.Minute) }()
+	waitForTimer(t, clock, testEpoch.Add(time.Minute))
+	clock.Advance(time.Minute)
+	if !<-done {
+		t.Error("sleepContext = false after the clock advanced, want true")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { done <- sleepContext(ctx, clock, time.Minute) }()
+	cancel()
+	if <-done {
+		t.Error("sleepContext = true after cancel, want false")
+	}
+}
+
+// waitForTimer blocks until something waits on the clock for due, so a following
+// Advance cannot race with the goroutine that is about to start waiting
+func waitForTimer(t *testing.T, clock *ManualClock, due time.Time) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		clock.mu.Lock()
+		for _, waiter := range clock.waiters {
+			if waiter.due.Equal(due) {
+				clock.mu.Unlock()
+				return
+			}
+		}
+		clock.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("nothing waits on the clock for %s", due)
+}
@@ -2,12 +2,14 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -19,53 +21,183 @@ type Login struct {
 	SecretKey  string `json:"secretKey"`
 }
 
-func (appConfig AppConfig) StartGateWayOperation(db *gorm.DB) {
+// controllerWorker tracks the report generation running for one controller
+type controllerWorker struct {
+	cancel  context.CancelFunc
+	batcher *ReportBatcher
+	done    <-chan struct{}
+}
+
+// StartGateWayOperation supervises the controllers in the database, reconciling every
+// interval until ctx is cancelled. It returns once every controller worker has drained.
+func (appConfig AppConfig) StartGateWayOperation(ctx context.Context, db *gorm.DB) {
 	log.Info("Starting gateway operations")
-	// for {
+	workers := make(map[int16]*controllerWorker)
+	// Workers of removed controllers that are still draining, by controller id
+	draining := make(map[int16]<-chan struct{})
+
+	// One scheduler and worker pool serve the objects of every controller
+	scheduler := appConfig.NewReportScheduler(db)
+	schedulerDone := make(chan struct{})
+	go func() {
+		defer close(schedulerDone)
+		scheduler.Run(ctx)
+	}()
+
+	ticker := appConfig.clock().NewTicker(appConfig.GatewayReconcileInterval)
+	defer ticker.Stop()
+	for {
+		appConfig.reconcileControllers(ctx, scheduler, workers, draining, db)
+		select {
+		case <-ctx.Done():
+			log.WithFields(logrus.Fields{"workers": len(workers), "draining": len(draining)}).Info("Stopping gateway operations")
+			for _, worker := range workers {
+				worker.cancel()
+			}
+			for _, worker := range workers {
+				<-worker.done
+			}
+			for _, done := range draining {
+				<-done
+			}
+			authWorkers.Wait()
+			<-schedulerDone
+			return
+		case <-ticker.C():
+		}
+	}
+}
+
+// reconcileControllers runs auth and heartbeat checks for every controller, starts
+// workers for controllers that are new and stops workers for controllers that are gone.
+// A controller that comes back is only restarted once its previous worker has drained,
+// since the drain clears the controller's schedule and derived objects.
+func (appConfig AppConfig) reconcileControllers(ctx context.Context, scheduler *ReportScheduler, workers map[int16]*controllerWorker, draining map[int16]<-chan struct{}, db *gorm.DB) {
+	appConfig.LoadFaultScenarios(db)
+
+	for id, done := range draining {
+		select {
+		case <-done:
+			delete(draining, id)
+		default:
+		}
+	}
+
 	var controllers []ControllerMaster
 
 	result := db.Find(&controllers)
 	if result.Error != nil {
-		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			log.Warn("No controllers found in database")
-		} else {
-			log.WithError(result.Error).Error("Failed to fetch controllers")
-		}
+		log.WithError(result.Error).Error("Failed to fetch controllers")
 		return
 	}
 	log.WithFields(logrus.Fields{
 		"count": len(controllers),
 	}).Info("Controllers fetched successfully")
 
+	seen := make(map[int16]bool, len(controllers))
 	for _, controller := range controllers {
-		appConfig.performAuthOperationIfRequired(controller, db)
-		appConfig.sendHeartBeatIfRequired(controller, db)
+		seen[controller.Id] = true
+		if ctx.Err() != nil {
+			continue
+		}
+		if !appConfig.authenticateInBackground(ctx, controller, db) {
+			continue
+		}
+		appConfig.sendHeartBeatIfRequired(ctx, controller, db)
+
+		// A heartbeat may have logged the controller in again, pick up the saved record
+		if err := db.First(&controller, controller.Id).Error; err != nil {
+			log.WithError(err).WithField("controller", controller.MacAddress).Error("Failed to reload controller")
+			continue
+		}
+
+		if worker, ok := workers[controller.Id]; ok {
+			worker.batcher.SetController(controller)
+			continue
+		}
+		if _, ok := draining[controller.Id]; ok {
+			log.WithField("controller", controller.MacAddress).Info("Previous worker still draining, starting on a later reconcile")
+			continue
+		}
+
 		//Start in a different thread
-		go appConfig.StartReportGenerationForController(controller, db)
+		workerCtx, cancel := context.WithCancel(ctx)
+		batcher, done, err := appConfig.StartReportGenerationForController(workerCtx, scheduler, controller, db)
+		if err != nil {
+			cancel()
+			log.WithError(err).WithField("controller", controller.MacAddress).Error("Failed to start report generation")
+			continue
+		}
+		workers[controller.Id] = &controllerWorker{cancel: cancel, batcher: batcher, done: done}
+		log.WithField("controller", controller.MacAddress).Info("Started controller worker")
+	}
+
+	for id, worker := range workers {
+		if !seen[id] {
+			worker.cancel()
+			delete(workers, id)
+			draining[id] = worker.done
+			log.WithField("controller", worker.batcher.Controller().MacAddress).Info("Stopped worker for removed controller")
+		}
 	}
-	// sleep for 30s
-	// time.Sleep(30 * time.Second)
-	// }
 }
 
-func (appConfig AppConfig) sendHeartBeatIfRequired(controller ControllerMaster, db *gorm.DB) {
-	timeNow := time.Now()
+func (appConfig AppConfig) sendHeartBeatIfRequired(ctx context.Context, controller ControllerMaster, db *gorm.DB) {
+	timeNow := appConfig.clock().Now()
 	shouldSendHeartBeat := false
 	if controller.LastHeartBeat.IsZero() {
 		shouldSendHeartBeat = true
+	} else if controller.LastHeartBeat.After(timeNow) {
+		// Saved by a faster or later-started simulated clock, waiting for it could take days
+		shouldSendHeartBeat = true
 	} else if timeNow.Sub(controller.LastHeartBeat) > 1*time.Minute {
 		shouldSendHeartBeat = true
 	}
 	if shouldSendHeartBeat {
 		controller.LastHeartBeat = timeNow
-		isSuccess := appConfig.sendHeartBeat(controller, db)
+		isSuccess := appConfig.sendHeartBeat(ctx, controller, db)
 		if isSuccess {
 			appConfig.saveControllerData(controller, db)
+
+			// Server is reachable again, deliver anything buffered during the outage
+			if appConfig.hasOutboxBacklog(controller, db) {
+				if err := appConfig.flushOutbox(controller, db); err != nil {
+					log.WithError(err).WithField("controller", controller.MacAddress).Warn("Outbox not fully flushed")
+				}
+			}
 		}
 	}
 }
 
-func (appConfig AppConfig) performAuthOperationIfRequired(controller ControllerMaster, db *gorm.DB) {
+// Controllers whose credentials are being fetched, by ControllerMaster.Id
+var (
+	authInFlight sync.Map
+	authWorkers  sync.WaitGroup
+)
+
+// authenticateInBackground reports whether the controller has its credentials. When it
+// does not, they are fetched in a goroutine so the secret key retries of one controller
+// do not hold up the reconcile pass for the others; the saved record is picked up on a
+// later reconcile.
+func (appConfig AppConfig) authenticateInBackground(ctx context.Context, controller ControllerMaster, db *gorm.DB) bool {
+	if controller.Password != "" && controller.Token != "" {
+		return true
+	}
+	if _, running := authInFlight.LoadOrStore(controller.Id, struct{}{}); running {
+		return false
+	}
+	authWorkers.Add(1)
+	go func() {
+		defer authWorkers.Done()
+		defer authInFlight.Delete(controller.Id)
+		appConfig.performAuthOperationIfRequired(ctx, controller, db)
+	}()
+	return false
+}
+
+// performAuthOperationIfRequired fetches the secret key and logs in when the controller
+// lacks them; the secret key retries wait on the clock and give up when ctx ends
+func (appConfig AppConfig) performAuthOperationIfRequired(ctx context.Context, controller ControllerMaster, db *gorm.DB) {
 
 	if controller.Password == "" {
 		log.Info("Getting secret key for: " + controller.MacAddress)
@@ -90,8 +222,9 @@ func (appConfig AppConfig) performAuthOperationIfRequired(controller ControllerM
 					"mac_address": controller.MacAddress,
 				}).Warn("Failed to get secret key, retrying...")
 
-				if attempt < maxRetries {
-					time.Sleep(retryDelay)
+				if attempt < maxRetries && !sleepContext(ctx, appConfig.clock(), retryDelay) {
+					log.WithField("mac_address", controller.MacAddress).Info("Stopped getting secret key")
+					return
 				}
 				continue
 			}
@@ -108,8 +241,9 @@ func (appConfig AppConfig) performAuthOperationIfRequired(controller ControllerM
 					"mac_address": controller.MacAddress,
 				}).Warn("Empty secret key received, retrying...")
 
-				if attempt < maxRetries {
-					time.Sleep(retryDelay)
+				if attempt < maxRetries && !sleepContext(ctx, appConfig.clock(), retryDelay) {
+					log.WithField("mac_address", controller.MacAddress).Info("Stopped getting secret key")
+					return
 				}
 			}
 		}
@@ -142,7 +276,7 @@ func (appConfig AppConfig) performAuthOperationIfRequired(controller ControllerM
 }
 
 func (appConfig AppConfig) saveControllerData(controller ControllerMaster, db *gorm.DB) error {
-	if err := db.Save(&controller).Error; err != nil {
+	if err := db.Omit("uplink_seq_id", "acked_uplink_seq_id").Save(&controller).Error; err != nil {
 		log.WithError(err).WithField("controller_name", controller.ControllerName).Error("Failed to save controller token")
 		return err
 	} else {
@@ -151,7 +285,7 @@ func (appConfig AppConfig) saveControllerData(controller ControllerMaster, db *g
 	}
 }
 
-func (appConfig AppConfig) sendHeartBeat(controller ControllerMaster, db *gorm.DB) bool {
+func (appConfig AppConfig) sendHeartBeat(ctx context.Context, controller ControllerMaster, db *gorm.DB) bool {
 	url := fmt.Sprintf("%s/api/gms/sync/v1/to-controller", appConfig.ServerUrl)
 	log.Info("URL for heartbeat: ", url)
 	req, err := http.NewRequest("GET", url, nil)
@@ -160,31 +294,37 @@ func (appConfig AppConfig) sendHeartBeat(controller ControllerMaster, db *gorm.D
 		return false
 	}
 	req.Header.Set("Authorization", "Bearer "+controller.Token)
-	req.Header.Set("seqId", "-1")
-	req.Header.Set("isRebooted", "false")
+	req.Header.Set("seqId", strconv.FormatInt(appConfig.currentUplinkSeqId(controller, db), 10))
+	bootGeneration, isRebooted := rebootStatus(controller)
+	req.Header.Set("isRebooted", strconv.FormatBool(isRebooted))
 
 	res, err := GetHttpClient().Do(req)
 	if err != nil {
 		log.Errorf("HTTP Error : %v", err)
+		return false
 	}
+	defer res.Body.Close()
 
 	if res.StatusCode == http.StatusUnauthorized {
 		log.Error("Gateway got logged out")
 		controller.Token = ""
-		appConfig.performAuthOperationIfRequired(controller, db)
+		appConfig.performAuthOperationIfRequired(ctx, controller, db)
 		return false
 	}
 
+	//read the response, it carries any pending downlink commands
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		log.Errorf("failed to read response: %v", err)
+	}
+
 	if res.StatusCode == http.StatusOK {
 		log.Info("Heartbeat for " + controller.MacAddress + " sent successfully")
+		markSynced(controller, bootGeneration)
+		appConfig.processDownlinks(controller, resBody, db)
 		return true
 	}
 
-	//read the response for debug
-	resBody, err := io.ReadAll(res.Body)
-	if err != nil {
-		log.Errorf("failed to read response: %v", err)
-	}
 	log.WithField("response", string(resBody)).Info("Got the response")
 	return false
 
@@ -194,26 +334,26 @@ func (appConfig AppConfig) GetSecretKey(macAddress string) (string, error) {
 	log.Info("URL for get Key : ", url)
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		log.Errorf("Error while creating request %v", err)
+		return "", fmt.Errorf("failed to create request: %v", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
 
 	res, err := GetHttpClient().Do(req)
 	if err != nil {
-		log.Errorf("request failed: %v", err)
+		return "", fmt.Errorf("request failed: %v", err)
 	}
 
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
-		log.Errorf("HTTP error: %d", res.StatusCode)
+		return "", fmt.Errorf("HTTP error: %d", res.StatusCode)
 	}
 
 	//read the response
 	resBody, err := io.ReadAll(res.Body)
 	if err != nil {
-		log.Errorf("failed to read response: %v", err)
+		return "", fmt.Errorf("failed to read response: %v", err)
 	}
 
 	log.WithField("response", string(resBody)).Info("Got the response")
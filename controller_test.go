@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newTestDB returns a handle that never reaches a server: reads come back empty
+// and writes fail, which the code under test only logs
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(mysql.New(mysql.Config{DSN: "test:test@tcp(127.0.0.1:1)/test?parseTime=True", SkipInitializeWithVersion: true}), &gorm.Config{
+		DryRun:               true,
+		DisableAutomaticPing: true,
+		Logger:               logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestSendHeartBeatIfRequired(t *testing.T) {
+	var heartbeats atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/gms/sync/v1/to-controller" {
+			heartbeats.Add(1)
+		}
+		w.Write([]byte(`{"success":{"data":{}}}`))
+	}))
+	defer server.Close()
+
+	clock := NewManualClock(testEpoch)
+	appConfig := AppConfig{ServerUrl: server.URL, Clock: clock}
+	db := newTestDB(t)
+	controller := ControllerMaster{Id: 1, MacAddress: "00:11:22:33:44:55", Token: "token", LastHeartBeat: testEpoch}
+
+	tests := []struct {
+		name    string
+		advance time.Duration
+		want    int32
+	}{
+		{"fresh heartbeat", 0, 0},
+		{"within a minute", 59 * time.Second, 0},
+		{"a minute exactly", time.Second, 0},
+		{"over a minute", time.Second, 1},
+	}
+	for _, tt := range tests {
+		clock.Advance(tt.advance)
+		appConfig.sendHeartBeatIfRequired(context.Background(), controller, db)
+		if got := heartbeats.Load(); got != tt.want {
+			t.Errorf("%s: %d heartbeats sent, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	controller.LastHeartBeat = time.Time{}
+	appConfig.sendHeartBeatIfRequired(context.Background(), controller, db)
+	if got := heartbeats.Load(); got != 2 {
+		t.Errorf("never sent: %d heartbeats sent, want 2", got)
+	}
+
+	// A heartbeat stored by a run whose clock was ahead does not hold this one back
+	controller.LastHeartBeat = clock.Now().Add(72 * time.Hour)
+	appConfig.sendHeartBeatIfRequired(context.Background(), controller, db)
+	if got := heartbeats.Load(); got != 3 {
+		t.Errorf("sent in the future: %d heartbeats sent, want 3", got)
+	}
+}
+
+func TestGetSecretKey(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/iqnext/controller/v1/nc/getSecretKey/ok":
+			w.Write([]byte(`{"success":{"data":{"secretKey":"secret"}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	defer server.Close()
+
+	tests := []struct {
+		name      string
+		serverUrl string
+		mac       string
+		want      string
+		wantErr   bool
+	}{
+		{"found", server.URL, "ok", "secret", false},
+		{"http error", server.URL, "missing", "", true},
+		{"unreachable", unreachable.URL, "ok", "", true},
+	}
+	for _, tt := range tests {
+		got, err := AppConfig{ServerUrl: tt.serverUrl}.GetSecretKey(tt.mac)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("%s: GetSecretKey = %q, %v, want %q and error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
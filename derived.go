@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// derivedObject is an object whose value comes from an expression over other objects of its controller
+type derivedObject struct {
+	live   *liveObject
+	key    objectKey
+	expr   exprNode
+	inputs map[string]objectKey // reference in the expression -> referenced object
+
+	evaluated     bool
+	lastEvaluated time.Time
+}
+
+// derivedGraph holds the derived objects of one controller that compiled and are not
+// part of a dependency cycle. Each one is scheduled on its own report interval and
+// reads the latest values of its inputs, so interval and delta() always span one
+// of its own intervals however often the inputs report.
+type derivedGraph struct {
+	mu      sync.Mutex
+	objects map[objectKey]*derivedObject
+}
+
+// derivedGraphs holds the graph of every running controller that has derived objects
+var derivedGraphs sync.Map
+
+// buildDerivedGraph compiles the expressions of a controller's derived objects. Objects
+// with invalid expressions or in a dependency cycle are left out and hold their value.
+func buildDerivedGraph(objects []WiredDeviceObject, lives map[objectKey]*liveObject) *derivedGraph {
+	byName := make(map[string][]objectKey)
+	for _, object := range objects {
+		byName[object.ObjectName] = append(byName[object.ObjectName], objectKey{object.ControllerId, object.ObjectId})
+	}
+	resolve := func(ref string) (objectKey, error) {
+		if ref[0] == '#' {
+			objectId, _ := strconv.ParseUint(ref[1:], 10, 32)
+			key := objectKey{objects[0].ControllerId, uint32(objectId)}
+			if _, ok := lives[key]; !ok {
+				return key, fmt.Errorf("no object %s on this controller", ref)
+			}
+			return key, nil
+		}
+		switch keys := byName[ref]; len(keys) {
+		case 0:
+			return objectKey{}, fmt.Errorf("no object named %q on this controller", ref)
+		case 1:
+			return keys[0], nil
+		default:
+			return objectKey{}, fmt.Errorf("object name %q is not unique, reference it by #objectId", ref)
+		}
+	}
+
+	pending := make(map[objectKey]*derivedObject)
+	for _, object := range objects {
+		if object.Expression == "" {
+			continue
+		}
+		key := objectKey{object.ControllerId, object.ObjectId}
+		derived, err := compileDerivedObject(object, lives[key], resolve)
+		if err != nil {
+			log.WithError(err).WithField("ObjectName", object.ObjectName).Error("Invalid derived object expression, holding last value")
+			continue
+		}
+		pending[key] = derived
+	}
+
+	// Repeatedly take the derived objects whose derived inputs are all placed
+	graph := &derivedGraph{objects: make(map[objectKey]*derivedObject)}
+	placed := make(map[objectKey]bool)
+	for progress := true; progress; {
+		progress = false
+		for _, object := range objects {
+			key := objectKey{object.ControllerId, object.ObjectId}
+			derived, ok := pending[key]
+			if !ok {
+				continue
+			}
+			ready := true
+			for _, input := range derived.inputs {
+				if _, isDerived := pending[input]; isDerived && !placed[input] {
+					ready = false
+				}
+			}
+			if ready {
+				graph.objects[key] = derived
+				placed[key] = true
+				delete(pending, key)
+				progress = true
+			}
+		}
+	}
+	for key, derived := range pending {
+		log.WithFields(logrus.Fields{"ObjectName": derived.live.object.ObjectName, "objectId": key.ObjectId}).Error("Derived object is part of a dependency cycle, holding last value")
+	}
+	return graph
+}
+
+func compileDerivedObject(object WiredDeviceObject, live *liveObject, resolve func(ref string) (objectKey, error)) (*derivedObject, error) {
+	expr, err := ParseExpression(object.Expression)
+	if err != nil {
+		return nil, err
+	}
+	derived := &derivedObject{live: live, key: objectKey{object.ControllerId, object.ObjectId}, expr: expr, inputs: make(map[string]objectKey)}
+	for _, ref := range expressionRefs(expr) {
+		input, err := resolve(ref)
+		if err != nil {
+			return nil, err
+		}
+		if input == derived.key {
+			return nil, fmt.Errorf("expression references the object itself")
+		}
+		derived.inputs[ref] = input
+	}
+	return derived, nil
+}
+
+// findDerivedObject returns the derived object behind a key if its controller's graph has it
+func findDerivedObject(key objectKey) (*derivedGraph, *derivedObject, bool) {
+	value, ok := derivedGraphs.Load(key.ControllerId)
+	if !ok {
+		return nil, nil, false
+	}
+	graph := value.(*derivedGraph)
+	derived, ok := graph.objects[key]
+	return graph, derived, ok
+}
+
+// evaluateDerived recomputes a derived object for its report slot and queues its report
+func (appConfig AppConfig) evaluateDerived(batcher *ReportBatcher, graph *derivedGraph, derived *derivedObject, timeNow time.Time, db *gorm.DB) {
+	graph.mu.Lock()
+	defer graph.mu.Unlock()
+	appConfig.evaluateDerivedObject(batcher, derived, timeNow, db)
+}
+
+func (appConfig AppConfig) evaluateDerivedObject(batcher *ReportBatcher, derived *derivedObject, timeNow time.Time, db *gorm.DB) {
+	live := derived.live
+	live.mu.Lock()
+	objectName := live.object.ObjectName
+	interval := reportInterval(live.object).Seconds()
+	live.mu.Unlock()
+	if derived.evaluated {
+		interval = timeNow.Sub(derived.lastEvaluated).Seconds()
+	}
+
+	result, err := derived.expr.eval(&exprContext{
+		interval: interval,
+		lookup: func(ref string) (float64, error) {
+			input, ok := findLiveObject(derived.inputs[ref].ControllerId, derived.inputs[ref].ObjectId)
+			if !ok {
+				return 0, fmt.Errorf("object %s is not running", ref)
+			}
+			input.mu.Lock()
+			defer input.mu.Unlock()
+			return input.object.preciseValue(), nil
+		},
+	})
+	derived.evaluated, derived.lastEvaluated = true, timeNow
+	if err == nil && (math.IsNaN(result) || math.IsInf(result, 0)) {
+		err = fmt.Errorf("expression evaluated to %v", result)
+	}
+	if err != nil {
+		log.WithError(err).WithField("ObjectName", objectName).Warn("Derived object not updated")
+		return
+	}
+
+	live.mu.Lock()
+	live.object.setValue(result)
+	object := live.object
+	sendReport := live.shouldReport(timeNow)
+	if sendReport {
+		live.markReported(timeNow)
+	}
+	live.mu.Unlock()
+	log.WithFields(logrus.Fields{"ObjectName": object.ObjectName, "objectValue": object.ReportValue}).Info("Derived value")
+
+	if sendReport {
+		queueReport(batcher, live, object, timeNow)
+	}
+	if !appConfig.savesGeneratedValues() {
+		return
+	}
+	if err := db.Save(&object).Error; err != nil {
+		log.WithError(err).Error("Failed to save derived object value")
+	}
+}
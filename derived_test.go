@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDerivedObjectEvaluatesOncePerOwnInterval(t *testing.T) {
+	appConfig := AppConfig{SimSeedFixed: true}
+	db := newTestDB(t)
+
+	objects := []WiredDeviceObject{
+		{ControllerId: 9, ObjectId: 1, ObjectName: "meter", ReportIntervalSeconds: 20},
+		{ControllerId: 9, ObjectId: 2, ObjectName: "power", ReportIntervalSeconds: 60, Expression: "delta(meter) / interval"},
+	}
+	lives := make(map[objectKey]*liveObject)
+	for _, object := range objects {
+		live := trackLiveObject(object)
+		lives[objectKey{object.ControllerId, object.ObjectId}] = live
+		defer untrackLiveObject(live)
+	}
+	graph := buildDerivedGraph(objects, lives)
+	if len(graph.objects) != 1 {
+		t.Fatalf("graph has %d derived objects, want 1", len(graph.objects))
+	}
+	derivedGraphs.Store(int16(9), graph)
+	defer derivedGraphs.Delete(int16(9))
+
+	meter, power := lives[objectKey{9, 1}], lives[objectKey{9, 2}]
+	batcher := appConfig.NewReportBatcher(ControllerMaster{Id: 9}, db)
+
+	// The meter moves 10 per 20s report, three reports per derived interval. Every
+	// derived slot must see the whole 60s window, never one 20s step of it.
+	meterValue := 0.0
+	for step := 0; step <= 9; step++ {
+		now := testEpoch.Add(time.Duration(step) * 20 * time.Second)
+		meter.mu.Lock()
+		meter.object.setValue(meterValue)
+		meter.mu.Unlock()
+		meterValue += 10
+
+		if step%3 != 0 {
+			continue
+		}
+		appConfig.generateReportForObject(batcher, power, now, db)
+		power.mu.Lock()
+		got := power.object.preciseValue()
+		power.mu.Unlock()
+		want := 0.5
+		if step == 0 {
+			want = 0
+		}
+		if got != want {
+			t.Errorf("power at %v = %v, want %v", now.Sub(testEpoch), got, want)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Ack status codes sent in TagAckStatus
+const (
+	AckStatusOk          = 0
+	AckStatusFailed      = 1
+	AckStatusUnsupported = 2
+)
+
+var ErrDownlinkUnsupported = errors.New("downlink command not supported")
+
+// DownlinkHandler applies one decoded downlink frame to the simulated controller
+type DownlinkHandler func(appConfig AppConfig, controller ControllerMaster, frame *TagVO, db *gorm.DB) error
+
+var downlinkHandlers = map[byte]DownlinkHandler{}
+
+func init() {
+	RegisterDownlinkHandler(CommandWriteProperty, handleWriteProperty)
+	RegisterDownlinkHandler(CommandConfigChange, handleConfigChange)
+	RegisterDownlinkHandler(CommandTimeSync, handleTimeSync)
+}
+
+// RegisterDownlinkHandler adds or replaces the handler of a downlink command
+func RegisterDownlinkHandler(commandId byte, handler DownlinkHandler) {
+	downlinkHandlers[commandId] = handler
+}
+
+// processDownlinks decodes the frames in a to-controller response, runs their
+// handlers and acknowledges every frame in a single uplink. Each frame is checked
+// against the schema on its own, so an unknown command or a bad tag is acked as
+// unsupported or failed without holding up the rest of its reportFor group.
+//
+// The response shape is an assumption, the Java side has no reference for it yet;
+// it mirrors the uplink payload:
+//
+//	{"success":{"data":{"downlinkSeqId":n,"dataToController":{"<reportFor>":[bytes...]}}}}
+func (appConfig AppConfig) processDownlinks(controller ControllerMaster, resBody []byte, db *gorm.DB) {
+	var parsed map[string]interface{}
+	if err := json.Unmarshal(resBody, &parsed); err != nil {
+		log.WithError(err).Warn("Heartbeat response is not JSON, no downlinks processed")
+		return
+	}
+	success, _ := parsed["success"].(map[string]interface{})
+	data, _ := success["data"].(map[string]interface{})
+	dataToController, _ := data["dataToController"].(map[string]interface{})
+	if len(dataToController) == 0 {
+		return
+	}
+	downlinkSeqId := int32(-1)
+	if seqId, ok := data["downlinkSeqId"].(float64); ok {
+		downlinkSeqId = int32(seqId)
+	}
+
+	keys := make([]int, 0, len(dataToController))
+	for key := range dataToController {
+		reportFor, err := strconv.Atoi(key)
+		if err != nil {
+			log.WithField("reportFor", key).Warn("Skipping downlink with invalid reportFor")
+			continue
+		}
+		keys = append(keys, reportFor)
+	}
+	sort.Ints(keys)
+
+	acks := make(map[int][]byte)
+	for _, reportFor := range keys {
+		raw, err := toByteArray(dataToController[strconv.Itoa(reportFor)])
+		if err != nil {
+			log.WithError(err).WithField("reportFor", reportFor).Error("Invalid downlink payload")
+			continue
+		}
+		// Frames before a framing error are still handled, the rest cannot be split apart
+		frames, err := decodeRequestMessages(raw)
+		if err != nil {
+			log.WithError(err).WithField("reportFor", reportFor).Error("Failed to decode downlink frames")
+		}
+
+		for _, frame := range frames {
+			status, message := byte(AckStatusOk), ""
+			if err = frame.Validate(); err == nil {
+				if handler, ok := downlinkHandlers[frame.CommandId]; !ok {
+					err = fmt.Errorf("%w: %d", ErrDownlinkUnsupported, frame.CommandId)
+				} else {
+					err = handler(appConfig, controller, frame, db)
+				}
+			}
+			if err != nil {
+				status, message = AckStatusFailed, err.Error()
+				if errors.Is(err, ErrDownlinkUnsupported) || errors.Is(err, ErrUnknownCommand) {
+					status = AckStatusUnsupported
+				}
+			}
+			log.WithFields(logrus.Fields{
+				"controller": controller.MacAddress,
+				"commandId":  frame.CommandId,
+				"status":     status,
+			}).Info("Processed downlink command")
+
+			ack, err := buildAckFrame(frame, status, downlinkSeqId, message)
+			if err != nil {
+				log.WithError(err).Error("Failed to build downlink ack")
+				continue
+			}
+			acks[reportFor] = append(acks[reportFor], ack...)
+		}
+	}
+
+	if len(acks) == 0 {
+		return
+	}
+	// Like report batches, acks queue behind buffered uplinks so seqIds reach the server in order
+	if queued, err := appConfig.sendInOrder(controller, acks, db); err != nil {
+		if queued {
+			log.WithError(err).Error("Failed to store downlink acks")
+		} else {
+			log.WithError(err).WithField("controller", controller.MacAddress).Warn("Downlink acks not delivered, kept in outbox")
+		}
+	}
+}
+
+// buildAckFrame encodes the acknowledgement of a downlink frame
+func buildAckFrame(frame *TagVO, status byte, downlinkSeqId int32, message string) ([]byte, error) {
+	ack := &TagVO{CommandId: CommandAck}
+	ack.AddByteValue(TagAckCommandId, frame.CommandId)
+	ack.AddByteValue(TagAckStatus, status)
+	switch frame.CommandId {
+	case CommandWriteProperty, CommandConfigChange:
+		if objectId, err := frame.GetIntValue(TagDownlinkObjectId); err == nil {
+			ack.AddIntValue(TagAckObjectId, objectId)
+		}
+	}
+	ack.AddIntValue(TagAckDownlinkSeqId, downlinkSeqId)
+	if message != "" {
+		ack.AddStringValue(TagAckMessage, message)
+	}
+	return ack.CreateRequestMessage()
+}
+
+// toByteArray converts a decoded JSON number array to bytes
+func toByteArray(value interface{}) ([]byte, error) {
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected an array, got %T", value)
+	}
+	raw := make([]byte, len(items))
+	for i, item := range items {
+		b, ok := item.(float64)
+		if !ok || b < 0 || b > 255 {
+			return nil, fmt.Errorf("invalid byte %v at index %d", item, i)
+		}
+		raw[i] = byte(b)
+	}
+	return raw, nil
+}
+
+// updateObject applies a change to an object, through its live state when reports are running
+func updateObject(controller ControllerMaster, objectId uint32, apply func(object *WiredDeviceObject) error, db *gorm.DB) error {
+	if live, ok := findLiveObject(int16(controller.ControllerId), objectId); ok {
+		live.mu.Lock()
+		object := live.object
+		if err := apply(&object); err != nil {
+			live.mu.Unlock()
+			return err
+		}
+		live.object = object
+		live.mu.Unlock()
+		return db.Save(&object).Error
+	}
+
+	var object WiredDeviceObject
+	if err := db.Where("controller_id = ? AND object_id = ?", controller.ControllerId, objectId).First(&object).Error; err != nil {
+		return fmt.Errorf("object %d: %w", objectId, err)
+	}
+	if err := apply(&object); err != nil {
+		return err
+	}
+	return db.Save(&object).Error
+}
+
+// decodeDownlinkValue reads the value tag according to the BACnet datatype in the frame
+func decodeDownlinkValue(frame *TagVO) (float32, error) {
+	dataType, err := frame.GetByteValue(TagDownlinkDataType)
+	if err != nil {
+		return 0, err
+	}
+	switch dataType {
+	case BacnetBoolean:
+		value, err := frame.GetBooleanValue(TagDownlinkValue)
+		if value {
+			return 1, err
+		}
+		return 0, err
+	case BacnetUnsigned, BacnetEnumerated:
+		value, err := frame.GetUnsignedValue(TagDownlinkValue)
+		return float32(value), err
+	case BacnetSigned:
+		value, err := frame.GetIntValue(TagDownlinkValue)
+		return float32(value), err
+	case BacnetReal:
+		value, err := frame.GetFloatValue(TagDownlinkValue)
+		return value, err
+	case BacnetDouble:
+		value, err := frame.GetDoubleValue(TagDownlinkValue)
+		return float32(value), err
+	case BacnetCharString:
+		raw, err := frame.GetStringValue(TagDownlinkValue)
+		if err != nil {
+			return 0, err
+		}
+		value, err := strconv.ParseFloat(raw, 32)
+		return float32(value), err
+	}
+	return 0, fmt.Errorf("%w: datatype %d", ErrDownlinkUnsupported, dataType)
+}
+
+func handleWriteProperty(appConfig AppConfig, controller ControllerMaster, frame *TagVO, db *gorm.DB) error {
+	objectId, err := frame.GetIntValue(TagDownlinkObjectId)
+	if err != nil {
+		return err
+	}
+	value, err := decodeDownlinkValue(frame)
+	if err != nil {
+		return err
+	}
+	return updateObject(controller, uint32(objectId), func(object *WiredDeviceObject) error {
+		log.WithFields(logrus.Fields{"ObjectName": object.ObjectName, "from": object.ReportValue, "to": value}).Info("Write property")
+		object.setValue(float64(value))
+		return nil
+	}, db)
+}
+
+func handleConfigChange(appConfig AppConfig, controller ControllerMaster, frame *TagVO, db *gorm.DB) error {
+	objectId, err := frame.GetIntValue(TagDownlinkObjectId)
+	if err != nil {
+		return err
+	}
+	key, err := frame.GetStringValue(TagConfigKey)
+	if err != nil {
+		return err
+	}
+	value, err := frame.GetStringValue(TagConfigValue)
+	if err != nil {
+		return err
+	}
+	return updateObject(controller, uint32(objectId), func(object *WiredDeviceObject) error {
+		log.WithFields(logrus.Fields{"ObjectName": object.ObjectName, "key": key, "value": value}).Info("Config change")
+		return applyObjectConfig(object, key, value)
+	}, db)
+}
+
+// applyObjectConfig sets one configurable field of an object from its string form
+func applyObjectConfig(object *WiredDeviceObject, key string, value string) error {
+	switch key {
+	case "objectName":
+		object.ObjectName = value
+	case "reportType":
+		parsed, err := strconv.ParseInt(value, 10, 8)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", key, err)
+		}
+		object.ReportType = int8(parsed)
+	case "reportDataType":
+		parsed, err := strconv.ParseInt(value, 10, 8)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", key, err)
+		}
+		object.ReportDataType = int8(parsed)
+	case "reportIntervalSeconds":
+		parsed, err := strconv.ParseInt(value, 10, 32)
+		if err != nil || parsed < 0 {
+			return fmt.Errorf("invalid %s: %q", key, value)
+		}
+		object.ReportIntervalSeconds = int32(parsed)
+	case "reportMode":
+		parsed, err := strconv.ParseInt(value, 10, 8)
+		if err != nil || parsed < 0 || parsed > ReportModeCov {
+			return fmt.Errorf("invalid %s: %q", key, value)
+		}
+		object.ReportMode = int8(parsed)
+	case "covIncrement":
+		parsed, err := strconv.ParseFloat(value, 32)
+		if err != nil || parsed < 0 {
+			return fmt.Errorf("invalid %s: %q", key, value)
+		}
+		object.CovIncrement = float32(parsed)
+	case "covMaxSilenceSeconds":
+		parsed, err := strconv.ParseInt(value, 10, 32)
+		if err != nil || parsed < 0 {
+			return fmt.Errorf("invalid %s: %q", key, value)
+		}
+		object.CovMaxSilenceSeconds = int32(parsed)
+	default:
+		return fmt.Errorf("%w: config key %q", ErrDownlinkUnsupported, key)
+	}
+	return nil
+}
+
+// clockOffsets holds the server-minus-local time difference learned from time sync, per controller
+var clockOffsets sync.Map
+
+// controllerTime returns the controller's notion of the instant t, which the controller's own clock may skew
+func controllerTime(controller ControllerMaster, t time.Time) time.Time {
+	if offset, ok := clockOffsets.Load(controller.Id); ok {
+		return t.Add(offset.(time.Duration))
+	}
+	return t
+}
+
+func handleTimeSync(appConfig AppConfig, controller ControllerMaster, frame *TagVO, db *gorm.DB) error {
+	timestamp, err := frame.GetIntValue(TagTimeSyncTimestamp)
+	if err != nil {
+		return err
+	}
+	offset := time.Unix(int64(timestamp), 0).Sub(appConfig.clock().Now())
+	clockOffsets.Store(controller.Id, offset)
+	log.WithFields(logrus.Fields{"controller": controller.MacAddress, "offset": offset}).Info("Controller clock synchronised")
+	return nil
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var ErrInvalidExpression = errors.New("invalid expression")
+
+// Expressions of derived objects support numbers, object references, + - * / %,
+// comparisons and && || ! (true is 1, false is 0), parentheses and the functions
+// delta(x), abs(x), min(a, b), max(a, b) and if(cond, then, else). An object is
+// referenced by its name when that is a plain identifier, otherwise as #objectId.
+// interval is the number of seconds since the previous evaluation.
+type exprNode interface {
+	eval(ctx *exprContext) (float64, error)
+}
+
+// exprContext is what an expression sees while it is evaluated
+type exprContext struct {
+	lookup   func(ref string) (float64, error)
+	interval float64
+}
+
+type numberNode float64
+
+func (n numberNode) eval(ctx *exprContext) (float64, error) { return float64(n), nil }
+
+type refNode string
+
+func (n refNode) eval(ctx *exprContext) (float64, error) { return ctx.lookup(string(n)) }
+
+type intervalNode struct{}
+
+func (intervalNode) eval(ctx *exprContext) (float64, error) { return ctx.interval, nil }
+
+type unaryNode struct {
+	op string
+	x  exprNode
+}
+
+func (n *unaryNode) eval(ctx *exprContext) (float64, error) {
+	x, err := n.x.eval(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if n.op == "!" {
+		return boolValue(x == 0), nil
+	}
+	return -x, nil
+}
+
+type binaryNode struct {
+	op   string
+	l, r exprNode
+}
+
+func (n *binaryNode) eval(ctx *exprContext) (float64, error) {
+	l, err := n.l.eval(ctx)
+	if err != nil {
+		return 0, err
+	}
+	r, err := n.r.eval(ctx)
+	if err != nil {
+		return 0, err
+	}
+	switch n.op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		return l / r, nil
+	case "%":
+		return math.Mod(l, r), nil
+	case "==":
+		return boolValue(l == r), nil
+	case "!=":
+		return boolValue(l != r), nil
+	case "<":
+		return boolValue(l < r), nil
+	case "<=":
+		return boolValue(l <= r), nil
+	case ">":
+		return boolValue(l > r), nil
+	case ">=":
+		return boolValue(l >= r), nil
+	case "&&":
+		return boolValue(l != 0 && r != 0), nil
+	case "||":
+		return boolValue(l != 0 || r != 0), nil
+	}
+	return 0, fmt.Errorf("%w: unknown operator %q", ErrInvalidExpression, n.op)
+}
+
+// callNode is a function call; delta keeps the previous value of its argument
+type callNode struct {
+	name string
+	args []exprNode
+
+	hasPrevious bool
+	previous    float64
+}
+
+// arity of the supported functions
+var exprFunctions = map[string]int{"delta": 1, "abs": 1, "min": 2, "max": 2, "if": 3}
+
+func (n *callNode) eval(ctx *exprContext) (float64, error) {
+	args := make([]float64, len(n.args))
+	for i, arg := range n.args {
+		value, err := arg.eval(ctx)
+		if err != nil {
+			return 0, err
+		}
+		args[i] = value
+	}
+	switch n.name {
+	case "delta":
+		// the first evaluation has nothing to compare with and yields 0
+		change := 0.0
+		if n.hasPrevious {
+			change = args[0] - n.previous
+		}
+		n.hasPrevious, n.previous = true, args[0]
+		return change, nil
+	case "abs":
+		return math.Abs(args[0]), nil
+	case "min":
+		return math.Min(args[0], args[1]), nil
+	case "max":
+		return math.Max(args[0], args[1]), nil
+	case "if":
+		if args[0] != 0 {
+			return args[1], nil
+		}
+		return args[2], nil
+	}
+	return 0, fmt.Errorf("%w: unknown function %q", ErrInvalidExpression, n.name)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// expressionRefs lists the object references of an expression, each once
+func expressionRefs(node exprNode) []string {
+	var refs []string
+	seen := make(map[string]bool)
+	var walk func(exprNode)
+	walk = func(node exprNode) {
+		switch n := node.(type) {
+		case refNode:
+			if !seen[string(n)] {
+				seen[string(n)] = true
+				refs = append(refs, string(n))
+			}
+		case *unaryNode:
+			walk(n.x)
+		case *binaryNode:
+			walk(n.l)
+			walk(n.r)
+		case *callNode:
+			for _, arg := range n.args {
+				walk(arg)
+			}
+		}
+	}
+	walk(node)
+	return refs
+}
+
+// ParseExpression compiles the expression of a derived object
+func ParseExpression(src string) (exprNode, error) {
+	tokens, err := tokenizeExpression(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("%w: unexpected %q", ErrInvalidExpression, p.tokens[p.pos])
+	}
+	return node, nil
+}
+
+func tokenizeExpression(src string) ([]string, error) {
+	var tokens []string
+	runes := []rune(src)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsDigit(r) || r == '.':
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.' || runes[i] == 'e' || runes[i] == 'E' ||
+				((runes[i] == '+' || runes[i] == '-') && (runes[i-1] == 'e' || runes[i-1] == 'E'))) {
+				i++
+			}
+			tokens = append(tokens, string(runes[start:i]))
+		case unicode.IsLetter(r) || r == '_' || r == '#':
+			start := i
+			i++
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, string(runes[start:i]))
+		default:
+			if i+1 < len(runes) {
+				if two := string(runes[i : i+2]); two == "==" || two == "!=" || two == "<=" || two == ">=" || two == "&&" || two == "||" {
+					tokens = append(tokens, two)
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("+-*/%()<>!,", r) {
+				return nil, fmt.Errorf("%w: unexpected character %q", ErrInvalidExpression, r)
+			}
+			tokens = append(tokens, string(r))
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+// exprParser is a recursive descent parser, one method per precedence level
+type exprParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) expect(token string) error {
+	if p.peek() != token {
+		return fmt.Errorf("%w: expected %q, got %q", ErrInvalidExpression, token, p.peek())
+	}
+	p.pos++
+	return nil
+}
+
+// parseBinary parses a left-associative chain of the given operators
+func (p *exprParser) parseBinary(next func() (exprNode, error), ops ...string) (exprNode, error) {
+	left, err := next()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		matched := false
+		for _, candidate := range ops {
+			matched = matched || op == candidate
+		}
+		if !matched {
+			return left, nil
+		}
+		p.pos++
+		right, err := next()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, l: left, r: right}
+	}
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	return p.parseBinary(p.parseAnd, "||")
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	return p.parseBinary(p.parseComparison, "&&")
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	return p.parseBinary(p.parseSum, "==", "!=", "<", "<=", ">", ">=")
+}
+
+func (p *exprParser) parseSum() (exprNode, error) {
+	return p.parseBinary(p.parseProduct, "+", "-")
+}
+
+func (p *exprParser) parseProduct() (exprNode, error) {
+	return p.parseBinary(p.parseUnary, "*", "/", "%")
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if op := p.peek(); op == "-" || op == "!" {
+		p.pos++
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: op, x: x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	token := p.peek()
+	if token == "" {
+		return nil, fmt.Errorf("%w: unexpected end", ErrInvalidExpression)
+	}
+	p.pos++
+
+	switch first := []rune(token)[0]; {
+	case token == "(":
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return node, p.expect(")")
+	case unicode.IsDigit(first) || first == '.':
+		value, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid number %q", ErrInvalidExpression, token)
+		}
+		return numberNode(value), nil
+	case first == '#':
+		if _, err := strconv.ParseUint(token[1:], 10, 32); err != nil {
+			return nil, fmt.Errorf("%w: invalid object id %q", ErrInvalidExpression, token)
+		}
+		return refNode(token), nil
+	case unicode.IsLetter(first) || first == '_':
+		if p.peek() == "(" {
+			return p.parseCall(token)
+		}
+		if token == "interval" {
+			return intervalNode{}, nil
+		}
+		return refNode(token), nil
+	}
+	return nil, fmt.Errorf("%w: unexpected %q", ErrInvalidExpression, token)
+}
+
+func (p *exprParser) parseCall(name string) (exprNode, error) {
+	arity, ok := exprFunctions[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown function %q", ErrInvalidExpression, name)
+	}
+	p.pos++ // (
+	call := &callNode{name: name}
+	for p.peek() != ")" {
+		if len(call.args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+	}
+	p.pos++ // )
+	if len(call.args) != arity {
+		return nil, fmt.Errorf("%w: %s takes %d arguments, got %d", ErrInvalidExpression, name, arity, len(call.args))
+	}
+	return call, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+)
+
+func evalExpression(t *testing.T, src string, values map[string]float64) (float64, error) {
+	t.Helper()
+	expr, err := ParseExpression(src)
+	if err != nil {
+		return 0, err
+	}
+	return expr.eval(&exprContext{
+		interval: 30,
+		lookup: func(ref string) (float64, error) {
+			value, ok := values[ref]
+			if !ok {
+				return 0, fmt.Errorf("no object %s", ref)
+			}
+			return value, nil
+		},
+	})
+}
+
+func TestExpressionEval(t *testing.T) {
+	values := map[string]float64{"a": 6, "b": 4, "Meter_2": 10, "#17": 2.5}
+	tests := []struct {
+		src  string
+		want float64
+	}{
+		{"42", 42},
+		{"1.5e3", 1500},
+		{"2.5E-1", 0.25},
+		{"a + b", 10},
+		{"a - b - 1", 1},
+		{"a + b * 2", 14},
+		{"(a + b) * 2", 20},
+		{"a / b", 1.5},
+		{"a % b", 2},
+		{"-a + 1", -5},
+		{"--a", 6},
+		{"Meter_2 * #17", 25},
+		{"interval / 2", 15},
+		{"a > b", 1},
+		{"a <= b", 0},
+		{"a == 6 && b != 6", 1},
+		{"a < b || b < a", 1},
+		{"!a", 0},
+		{"!(a < b)", 1},
+		{"1 + 2 > 2 && 1", 1},
+		{"abs(b - a)", 2},
+		{"min(a, b)", 4},
+		{"max(a, min(b, 10))", 6},
+		{"if(a > b, a, b)", 6},
+		{"if(0, 1, 2)", 2},
+		{"delta(a)", 0},
+	}
+	for _, tt := range tests {
+		got, err := evalExpression(t, tt.src, values)
+		if err != nil {
+			t.Errorf("%q: %v", tt.src, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestExpressionDelta(t *testing.T) {
+	expr, err := ParseExpression("delta(meter) / interval")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meter float64
+	ctx := &exprContext{interval: 10, lookup: func(string) (float64, error) { return meter, nil }}
+
+	// delta keeps its previous argument between evaluations, the first one yields 0
+	for i, step := range []struct{ meter, want float64 }{{100, 0}, {150, 5}, {150, 0}, {120, -3}} {
+		meter = step.meter
+		got, err := expr.eval(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != step.want {
+			t.Errorf("evaluation %d = %v, want %v", i, got, step.want)
+		}
+	}
+}
+
+func TestExpressionDivisionByZero(t *testing.T) {
+	got, err := evalExpression(t, "a / 0", map[string]float64{"a": 1})
+	if err != nil || !math.IsInf(got, 1) {
+		t.Errorf("a / 0 = %v, %v, want +Inf", got, err)
+	}
+}
+
+func TestParseExpressionErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"a +",
+		"(a + b",
+		"a b",
+		"a $ b",
+		"1.2.3",
+		"#x",
+		"sqrt(a)",
+		"min(a)",
+		"if(a, b)",
+		"abs(a,)",
+		")",
+	}
+	for _, src := range tests {
+		if _, err := ParseExpression(src); !errors.Is(err, ErrInvalidExpression) {
+			t.Errorf("%q: err = %v, want %v", src, err, ErrInvalidExpression)
+		}
+	}
+}
+
+func TestExpressionRefs(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		{"1 + 2", nil},
+		{"a + b * a", []string{"a", "b"}},
+		{"if(#3 > interval, delta(Meter), -#3)", []string{"#3", "Meter"}},
+	}
+	for _, tt := range tests {
+		expr, err := ParseExpression(tt.src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := expressionRefs(expr); !slices.Equal(got, tt.want) {
+			t.Errorf("expressionRefs(%q) = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestExpressionLookupError(t *testing.T) {
+	if _, err := evalExpression(t, "a + missing", map[string]float64{"a": 1}); err == nil {
+		t.Error("evaluating an unknown reference succeeded, want an error")
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Fault types stored in FaultScenario.FaultType
+const (
+	FaultStuck      = "stuck"        // value freezes at the first faulted value
+	FaultSpike      = "spike"        // value jumps by magnitude
+	FaultZero       = "zero"         // value drops to 0
+	FaultNaN        = "nan"          // value is NaN
+	FaultOutOfRange = "out_of_range" // value far outside the rule's range, or value
+	FaultRollover   = "rollover"     // counter wraps at limit
+	FaultReset      = "reset"        // counter restarts from 0 at the start of the fault
+	FaultClockSkew  = "clock_skew"   // TAG 5 timestamp moved by seconds
+	FaultDuplicate  = "duplicate"    // report sent twice
+	FaultOutOfOrder = "out_of_order" // report held back and sent after the next one
+)
+
+// FaultScenario schedules bad field data for one object, or every object of a
+// controller when ObjectId is 0. It is active for DurationSeconds from StartAt,
+// or indefinitely when the duration is 0, and hits each report in that window with
+// the given Probability: 0 never, NULL always. Params is optional JSON such as
+// {"magnitude":500}, {"value":-999}, {"limit":65536} or {"seconds":3600}.
+type FaultScenario struct {
+	Id              uint32    `gorm:"primaryKey" json:"id"`
+	ControllerId    int16     `gorm:"index" json:"controllerId"`
+	ObjectId        uint32    `json:"objectId"`
+	FaultType       string    `gorm:"size:32" json:"faultType"`
+	StartAt         time.Time `json:"startAt"`
+	DurationSeconds int32     `json:"durationSeconds"`
+	Probability     *float32  `json:"probability"`
+	Params          string    `gorm:"type:text" json:"params"`
+}
+
+type faultParams struct {
+	Magnitude float64  `json:"magnitude"`
+	Value     *float64 `json:"value"`
+	Limit     float64  `json:"limit"`
+	Seconds   int64    `json:"seconds"`
+}
+
+type faultScenario struct {
+	FaultScenario
+	params faultParams
+}
+
+// faultState is what a fault remembers about one object between reports
+type faultState struct {
+	started bool
+	value   float32
+}
+
+var (
+	faultMu        sync.RWMutex
+	faultScenarios = make(map[int16][]*faultScenario)
+)
+
+// LoadFaultScenarios reloads the scheduled faults; it runs on every reconcile so faults can be added while running
+func (appConfig AppConfig) LoadFaultScenarios(db *gorm.DB) {
+	var scenarioList []FaultScenario
+	result := db.Find(&scenarioList)
+	if result.Error != nil && !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		log.Errorf("Error; %v", result.Error)
+		return
+	}
+
+	loaded := make(map[int16][]*faultScenario)
+	for _, scenario := range scenarioList {
+		parsed, err := parseFaultScenario(scenario)
+		if err != nil {
+			log.WithError(err).WithField("faultScenario", scenario.Id).Error("Invalid fault scenario, ignoring")
+			continue
+		}
+		loaded[scenario.ControllerId] = append(loaded[scenario.ControllerId], parsed)
+	}
+
+	faultMu.Lock()
+	faultScenarios = loaded
+	faultMu.Unlock()
+	log.WithFields(logrus.Fields{"scenariosCount": len(scenarioList)}).Debug("Fault scenarios loaded")
+}
+
+func parseFaultScenario(scenario FaultScenario) (*faultScenario, error) {
+	switch scenario.FaultType {
+	case FaultStuck, FaultSpike, FaultZero, FaultNaN, FaultOutOfRange, FaultRollover, FaultReset, FaultClockSkew, FaultDuplicate, FaultOutOfOrder:
+	default:
+		return nil, fmt.Errorf("unknown fault type %q", scenario.FaultType)
+	}
+	if p := scenario.Probability; p != nil && (*p < 0 || *p > 1) {
+		return nil, fmt.Errorf("probability must be in 0..1, got %v", *p)
+	}
+
+	parsed := &faultScenario{FaultScenario: scenario, params: faultParams{Magnitude: 1000, Limit: 65536, Seconds: 3600}}
+	if strings.TrimSpace(scenario.Params) != "" {
+		decoder := json.NewDecoder(strings.NewReader(scenario.Params))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&parsed.params); err != nil {
+			return nil, fmt.Errorf("invalid params: %w", err)
+		}
+	}
+	if parsed.params.Limit <= 0 {
+		return nil, fmt.Errorf("rollover limit must be positive, got %v", parsed.params.Limit)
+	}
+	return parsed, nil
+}
+
+// active reports whether the scenario covers the object at t
+func (f *faultScenario) active(objectId uint32, t time.Time) bool {
+	if f.ObjectId != 0 && f.ObjectId != objectId {
+		return false
+	}
+	if t.Before(f.StartAt) {
+		return false
+	}
+	return f.DurationSeconds <= 0 || t.Before(f.StartAt.Add(time.Duration(f.DurationSeconds)*time.Second))
+}
+
+// scenarioActive reports whether the scenario with the given id is among scenarios and covers the object at t
+func scenarioActive(scenarios []*faultScenario, id uint32, objectId uint32, t time.Time) bool {
+	for _, scenario := range scenarios {
+		if scenario.Id == id {
+			return scenario.active(objectId, t)
+		}
+	}
+	return false
+}
+
+// applyFaults changes a report about to be sent according to the faults active at
+// timeNow; call with mu held. The live value is left alone so generators carry on
+// from clean data once the fault ends.
+func (live *liveObject) applyFaults(object *WiredDeviceObject, timeNow time.Time) (timestamp time.Time, duplicate bool, holdBack bool) {
+	timestamp = timeNow
+
+	faultMu.RLock()
+	scenarios := faultScenarios[object.ControllerId]
+	faultMu.RUnlock()
+
+	// State of scenarios that ended or were removed is cleared, so a scenario that
+	// becomes active again starts over, e.g. a stuck fault freezes at a fresh value
+	for id := range live.faults {
+		if !scenarioActive(scenarios, id, object.ObjectId, timeNow) {
+			delete(live.faults, id)
+		}
+	}
+
+	for _, scenario := range scenarios {
+		if !scenario.active(object.ObjectId, timeNow) {
+			continue
+		}
+		if p := scenario.Probability; p != nil && live.rng.Float32() >= *p {
+			continue
+		}
+		if live.faults == nil {
+			live.faults = make(map[uint32]*faultState)
+		}
+		state, ok := live.faults[scenario.Id]
+		if !ok {
+			state = &faultState{}
+			live.faults[scenario.Id] = state
+		}
+
+		switch scenario.FaultType {
+		case FaultStuck:
+			if !state.started {
+				state.started, state.value = true, object.ReportValue
+			}
+			object.ReportValue = state.value
+		case FaultSpike:
+			object.ReportValue += float32(scenario.params.Magnitude)
+		case FaultZero:
+			object.ReportValue = 0
+		case FaultNaN:
+			object.ReportValue = float32(math.NaN())
+		case FaultOutOfRange:
+			object.ReportValue = outOfRangeValue(object.IqnextObjectType, scenario.params)
+		case FaultRollover:
+			object.ReportValue = float32(math.Mod(float64(object.ReportValue), scenario.params.Limit))
+		case FaultReset:
+			if !state.started {
+				state.started, state.value = true, object.ReportValue
+			}
+			object.ReportValue -= state.value
+		case FaultClockSkew:
+			timestamp = timestamp.Add(time.Duration(scenario.params.Seconds) * time.Second)
+		case FaultDuplicate:
+			duplicate = true
+		case FaultOutOfOrder:
+			holdBack = true
+		}
+		log.WithFields(logrus.Fields{"ObjectName": object.ObjectName, "fault": scenario.FaultType, "faultScenario": scenario.Id}).Debug("Fault injected")
+	}
+	return timestamp, duplicate, holdBack
+}
+
+// outOfRangeValue is the configured value, or ten ranges above the rule's maximum
+func outOfRangeValue(iqnextObjectType int16, params faultParams) float32 {
+	if params.Value != nil {
+		return float32(*params.Value)
+	}
+	rule := objectRulesMap[iqnextObjectType]
+	if rule.MaxValue > rule.MinValue {
+		return rule.MaxValue + 10*(rule.MaxValue-rule.MinValue)
+	}
+	return 1e6
+}
+
+// queueReport encodes the report of an object, applies its active faults and adds
+// the resulting frames to the batch. It returns the number of frames added.
+func queueReport(batcher *ReportBatcher, live *liveObject, object WiredDeviceObject, timeNow time.Time) int {
+	live.mu.Lock()
+	timestamp, duplicate, holdBack := live.applyFaults(&object, timeNow)
+	held := live.heldFrame
+	live.heldFrame = nil
+	// Only one report is held at a time, so the next one overtakes it
+	holdBack = holdBack && held == nil
+	frame, err := buildReportFrame(object, timestamp)
+	if err == nil && holdBack {
+		live.heldFrame = frame
+	}
+	live.mu.Unlock()
+
+	added := 0
+	if err != nil {
+		log.WithError(err).WithField("ObjectName", object.ObjectName).Error("Failed to build report")
+	} else if !holdBack {
+		batcher.Add(1, frame)
+		added++
+		if duplicate {
+			batcher.Add(1, frame)
+			added++
+		}
+	}
+	// A report held back by an out-of-order fault goes after the one that overtook it
+	if held != nil {
+		batcher.Add(1, held)
+		added++
+	}
+	return added
+}
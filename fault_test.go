@@ -0,0 +1,182 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// reportValues decodes the values of the report frames queued in a batcher
+func reportValues(t *testing.T, batcher *ReportBatcher) []float32 {
+	t.Helper()
+	batcher.mu.Lock()
+	data := append([]byte(nil), batcher.pending[1]...)
+	batcher.mu.Unlock()
+
+	frames, err := ParseRequestMessages(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make([]float32, 0, len(frames))
+	for _, frame := range frames {
+		value, err := frame.GetFloatValue(TagReportValue)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
+// setFaultScenarios installs scenarios for controller 1 and returns a func restoring the previous ones
+func setFaultScenarios(t *testing.T, scenarios ...FaultScenario) func() {
+	t.Helper()
+	var parsed []*faultScenario
+	for _, scenario := range scenarios {
+		p, err := parseFaultScenario(scenario)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed = append(parsed, p)
+	}
+	faultMu.Lock()
+	previous := faultScenarios
+	faultScenarios = map[int16][]*faultScenario{1: parsed}
+	faultMu.Unlock()
+	return func() {
+		faultMu.Lock()
+		faultScenarios = previous
+		faultMu.Unlock()
+	}
+}
+
+func TestQueueReportFaults(t *testing.T) {
+	never, always := float32(0), float32(1)
+	type report struct {
+		at    time.Duration
+		value float32
+	}
+	tests := []struct {
+		name           string
+		scenario       FaultScenario
+		reports        []report
+		wantValues     []float32
+		wantTimestamps []time.Duration
+	}{
+		{
+			name:           "probability 0 never hits",
+			scenario:       FaultScenario{FaultType: FaultZero, Probability: &never},
+			reports:        []report{{0, 5}, {10 * time.Second, 6}},
+			wantValues:     []float32{5, 6},
+			wantTimestamps: []time.Duration{0, 10 * time.Second},
+		},
+		{
+			name:           "probability NULL always hits",
+			scenario:       FaultScenario{FaultType: FaultZero},
+			reports:        []report{{0, 5}, {10 * time.Second, 6}},
+			wantValues:     []float32{0, 0},
+			wantTimestamps: []time.Duration{0, 10 * time.Second},
+		},
+		{
+			name:           "probability 1 always hits",
+			scenario:       FaultScenario{FaultType: FaultSpike, Probability: &always, Params: `{"magnitude":100}`},
+			reports:        []report{{0, 5}},
+			wantValues:     []float32{105},
+			wantTimestamps: []time.Duration{0},
+		},
+		{
+			name:           "duplicate",
+			scenario:       FaultScenario{FaultType: FaultDuplicate},
+			reports:        []report{{0, 5}},
+			wantValues:     []float32{5, 5},
+			wantTimestamps: []time.Duration{0, 0},
+		},
+		{
+			name:           "out of order",
+			scenario:       FaultScenario{FaultType: FaultOutOfOrder},
+			reports:        []report{{0, 5}, {10 * time.Second, 6}, {20 * time.Second, 7}},
+			wantValues:     []float32{6, 5},
+			wantTimestamps: []time.Duration{10 * time.Second, 0},
+		},
+		{
+			name:           "clock skew",
+			scenario:       FaultScenario{FaultType: FaultClockSkew, Params: `{"seconds":-120}`},
+			reports:        []report{{0, 5}},
+			wantValues:     []float32{5},
+			wantTimestamps: []time.Duration{-120 * time.Second},
+		},
+		{
+			name:           "outside the window",
+			scenario:       FaultScenario{FaultType: FaultZero, StartAt: testEpoch.Add(10 * time.Second), DurationSeconds: 10},
+			reports:        []report{{0, 5}, {10 * time.Second, 6}, {20 * time.Second, 7}},
+			wantValues:     []float32{5, 0, 7},
+			wantTimestamps: []time.Duration{0, 10 * time.Second, 20 * time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.scenario.Id, tt.scenario.ControllerId = 1, 1
+			defer setFaultScenarios(t, tt.scenario)()
+
+			object := WiredDeviceObject{ControllerId: 1, ObjectId: 3, ReportDataType: FLOAT}
+			live := &liveObject{object: object, rng: objectRand(object.ControllerId, object.ObjectId)}
+			batcher := AppConfig{}.NewReportBatcher(ControllerMaster{Id: 1}, nil)
+
+			for _, r := range tt.reports {
+				object.ReportValue = r.value
+				queueReport(batcher, live, object, testEpoch.Add(r.at))
+			}
+
+			values := reportValues(t, batcher)
+			timestamps := reportTimestamps(t, batcher)
+			if len(values) != len(tt.wantValues) {
+				t.Fatalf("values = %v, want %v", values, tt.wantValues)
+			}
+			for i := range tt.wantValues {
+				if values[i] != tt.wantValues[i] {
+					t.Errorf("values = %v, want %v", values, tt.wantValues)
+				}
+				if want := testEpoch.Add(tt.wantTimestamps[i]); !timestamps[i].Equal(want) {
+					t.Errorf("timestamp %d = %v, want %v", i, timestamps[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestFaultStateClearedWhenScenarioEnds(t *testing.T) {
+	stuck := FaultScenario{Id: 1, ControllerId: 1, FaultType: FaultStuck, StartAt: testEpoch, DurationSeconds: 15}
+	defer setFaultScenarios(t, stuck)()
+
+	object := WiredDeviceObject{ControllerId: 1, ObjectId: 3, ReportDataType: FLOAT}
+	live := &liveObject{object: object, rng: objectRand(object.ControllerId, object.ObjectId)}
+	batcher := AppConfig{}.NewReportBatcher(ControllerMaster{Id: 1}, nil)
+
+	report := func(at time.Duration, value float32) {
+		object.ReportValue = value
+		queueReport(batcher, live, object, testEpoch.Add(at))
+	}
+	report(0, 5)
+	report(10*time.Second, 6)
+	report(20*time.Second, 7)
+	if len(live.faults) != 0 {
+		t.Errorf("fault state kept after the scenario ended: %v", live.faults)
+	}
+
+	// The same scenario moved to a later window freezes at the value it starts on
+	stuck.StartAt = testEpoch.Add(30 * time.Second)
+	setFaultScenarios(t, stuck)
+	report(30*time.Second, 8)
+	report(40*time.Second, 9)
+
+	want := []float32{5, 5, 7, 8, 8}
+	values := reportValues(t, batcher)
+	if len(values) != len(want) {
+		t.Fatalf("values = %v, want %v", values, want)
+	}
+	for i := range want {
+		if values[i] != want[i] {
+			t.Errorf("values = %v, want %v", values, want)
+			break
+		}
+	}
+}
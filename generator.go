@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Generator types stored in WiredObjectRules.GeneratorType
+const (
+	GeneratorCounter    = "counter"
+	GeneratorRandomWalk = "random_walk"
+	GeneratorSine       = "sine"
+	GeneratorSquare     = "square"
+	GeneratorStep       = "step"
+	GeneratorNoise      = "noise"
+	GeneratorHold       = "hold"
+	GeneratorReplay     = "replay"
+)
+
+// GeneratorTick is what a generator sees each time its object reports.
+// Weight comes from the rule's load profile and is 1 when there is none.
+type GeneratorTick struct {
+	DeviceId  uint32
+	ObjectId  uint32
+	Now       time.Time
+	Interval  time.Duration
+	LastValue float64
+	Weight    float64
+	Rand      *rand.Rand
+}
+
+// ValueGenerator produces the next value of an object
+type ValueGenerator interface {
+	Next(tick GeneratorTick) float64
+}
+
+// generatorsByRule caches the generator built for each rule, keyed like objectRulesMap
+var generatorsByRule = make(map[int16]ValueGenerator)
+
+// generatorFor returns the generator of an object type, holding the last value when no rule exists
+func generatorFor(iqnextObjectType int16) ValueGenerator {
+	if generator, ok := generatorsByRule[iqnextObjectType]; ok {
+		return generator
+	}
+	return holdGenerator{}
+}
+
+// NewValueGenerator builds the generator selected by a rule's GeneratorType, reading
+// its GeneratorParams JSON. Rules without a type keep the original behaviour:
+// continuous rules count up, rules with a min/max range random-walk inside it.
+func NewValueGenerator(rule WiredObjectRules) (ValueGenerator, error) {
+	generatorType := rule.GeneratorType
+	if generatorType == "" {
+		switch {
+		case rule.IsContinuous:
+			generatorType = GeneratorCounter
+		case rule.MaxValue > rule.MinValue:
+			generatorType = GeneratorRandomWalk
+		default:
+			generatorType = GeneratorHold
+		}
+	}
+
+	switch generatorType {
+	case GeneratorCounter:
+		g := counterGenerator{Increment: float64(rule.Constant), RolloverLimit: rule.RolloverLimit, ResetProbability: rule.ResetProbability}
+		if err := decodeGeneratorParams(rule, &g); err != nil {
+			return nil, err
+		}
+		if g.RolloverLimit < 0 || g.ResetProbability < 0 || g.ResetProbability > 1 {
+			return nil, fmt.Errorf("counter needs rolloverLimit >= 0 and resetProbability in 0..1")
+		}
+		return g, nil
+	case GeneratorRandomWalk:
+		g := randomWalkGenerator{Min: float64(rule.MinValue), Max: float64(rule.MaxValue), MaxStep: float64(rule.MaxStep)}
+		if err := decodeGeneratorParams(rule, &g); err != nil {
+			return nil, err
+		}
+		if g.Max <= g.Min {
+			return nil, fmt.Errorf("random_walk needs max > min, got %v..%v", g.Min, g.Max)
+		}
+		if g.MaxStep <= 0 {
+			g.MaxStep = (g.Max - g.Min) * 0.05
+		}
+		return g, nil
+	case GeneratorSine:
+		g := sineGenerator{Baseline: float64(rule.MinValue+rule.MaxValue) / 2, Amplitude: float64(rule.MaxValue-rule.MinValue) / 2, PeriodSeconds: 86400}
+		if err := decodeGeneratorParams(rule, &g); err != nil {
+			return nil, err
+		}
+		if g.PeriodSeconds <= 0 {
+			return nil, fmt.Errorf("sine needs a positive periodSeconds")
+		}
+		return g, nil
+	case GeneratorSquare:
+		g := squareGenerator{Low: float64(rule.MinValue), High: float64(rule.MaxValue), PeriodSeconds: 3600, DutyCycle: 0.5}
+		if err := decodeGeneratorParams(rule, &g); err != nil {
+			return nil, err
+		}
+		if g.PeriodSeconds <= 0 || g.DutyCycle < 0 || g.DutyCycle > 1 {
+			return nil, fmt.Errorf("square needs a positive periodSeconds and a dutyCycle in 0..1")
+		}
+		return g, nil
+	case GeneratorStep:
+		var params stepParams
+		if err := decodeGeneratorParams(rule, &params); err != nil {
+			return nil, err
+		}
+		return newStepGenerator(params)
+	case GeneratorNoise:
+		g := noiseGenerator{Baseline: float64(rule.MinValue+rule.MaxValue) / 2, StdDev: float64(rule.MaxValue-rule.MinValue) / 6}
+		return g, decodeGeneratorParams(rule, &g)
+	case GeneratorHold:
+		return holdGenerator{}, nil
+	case GeneratorReplay:
+		var params replayParams
+		if err := decodeGeneratorParams(rule, &params); err != nil {
+			return nil, err
+		}
+		return newReplayGenerator(params)
+	}
+	return nil, fmt.Errorf("unknown generator type %q", generatorType)
+}
+
+// decodeGeneratorParams overlays the rule's JSON parameters on the defaults already in params
+func decodeGeneratorParams(rule WiredObjectRules, params any) error {
+	if strings.TrimSpace(rule.GeneratorParams) == "" {
+		return nil
+	}
+	decoder := json.NewDecoder(strings.NewReader(rule.GeneratorParams))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(params); err != nil {
+		return fmt.Errorf("invalid generatorParams for rule %d: %w", rule.Id, err)
+	}
+	return nil
+}
+
+// counterGenerator adds a constant each tick, scaled by the profile weight; a zero increment adds a random amount below 1.
+// Like a meter register it wraps at RolloverLimit, and it can reset to 0 at random.
+type counterGenerator struct {
+	Increment        float64 `json:"increment"`
+	RolloverLimit    float64 `json:"rolloverLimit"`
+	ResetProbability float64 `json:"resetProbability"`
+}
+
+func (g counterGenerator) Next(tick GeneratorTick) float64 {
+	if g.ResetProbability > 0 && tick.Rand.Float64() < g.ResetProbability {
+		return 0
+	}
+	increment := g.Increment
+	if increment == 0 {
+		increment = tick.Rand.Float64()
+	}
+	next := tick.LastValue + increment*tick.Weight
+	if g.RolloverLimit > 0 && next >= g.RolloverLimit {
+		next = math.Mod(next, g.RolloverLimit)
+	}
+	return next
+}
+
+// randomWalkGenerator moves by at most MaxStep per tick and stays inside Min..Max.
+// The profile weight shrinks the upper bound, so quiet hours sit near Min.
+type randomWalkGenerator struct {
+	Min     float64 `json:"min"`
+	Max     float64 `json:"max"`
+	MaxStep float64 `json:"maxStep"`
+}
+
+func (g randomWalkGenerator) Next(tick GeneratorTick) float64 {
+	upper := g.Min + (g.Max-g.Min)*min(tick.Weight, 1)
+	next := tick.LastValue + (tick.Rand.Float64()*2-1)*g.MaxStep
+	return min(max(next, g.Min), upper)
+}
+
+// secondsIntoPeriod is how far local wall time is into a repeating period, so daily periods align with midnight
+func secondsIntoPeriod(now time.Time, periodSeconds float64) float64 {
+	_, offset := now.Zone()
+	local := float64(now.Unix()+int64(offset)) + float64(now.Nanosecond())/1e9
+	return math.Mod(local, periodSeconds)
+}
+
+// sineGenerator follows a sine wave around a profile-weighted baseline; the default
+// one-day period gives a daily cycle peaking at PeakAtSeconds
+type sineGenerator struct {
+	Baseline      float64 `json:"baseline"`
+	Amplitude     float64 `json:"amplitude"`
+	PeriodSeconds float64 `json:"periodSeconds"`
+	PeakAtSeconds float64 `json:"peakAtSeconds"`
+}
+
+func (g sineGenerator) Next(tick GeneratorTick) float64 {
+	phase := (secondsIntoPeriod(tick.Now, g.PeriodSeconds) - g.PeakAtSeconds) / g.PeriodSeconds
+	return g.Baseline*tick.Weight + g.Amplitude*math.Cos(2*math.Pi*phase)
+}
+
+// squareGenerator is High (profile-weighted) for the first DutyCycle of every period and Low for the rest
+type squareGenerator struct {
+	Low           float64 `json:"low"`
+	High          float64 `json:"high"`
+	PeriodSeconds float64 `json:"periodSeconds"`
+	DutyCycle     float64 `json:"dutyCycle"`
+}
+
+func (g squareGenerator) Next(tick GeneratorTick) float64 {
+	if secondsIntoPeriod(tick.Now, g.PeriodSeconds) < g.DutyCycle*g.PeriodSeconds {
+		return g.High * tick.Weight
+	}
+	return g.Low
+}
+
+type stepParams struct {
+	Steps []struct {
+		At    string  `json:"at"`
+		Value float64 `json:"value"`
+	} `json:"steps"`
+}
+
+type scheduledStep struct {
+	at    time.Duration
+	value float64
+}
+
+// stepGenerator follows a daily schedule of set points, e.g. {"steps":[{"at":"08:00","value":21},{"at":"18:00","value":16}]}
+type stepGenerator struct {
+	steps []scheduledStep
+}
+
+func newStepGenerator(params stepParams) (ValueGenerator, error) {
+	if len(params.Steps) == 0 {
+		return nil, fmt.Errorf("step needs at least one step")
+	}
+	g := stepGenerator{}
+	for _, step := range params.Steps {
+		at, err := time.Parse("15:04", step.At)
+		if err != nil {
+			return nil, fmt.Errorf("invalid step time %q: %w", step.At, err)
+		}
+		g.steps = append(g.steps, scheduledStep{
+			at:    time.Duration(at.Hour())*time.Hour + time.Duration(at.Minute())*time.Minute,
+			value: step.Value,
+		})
+	}
+	sort.Slice(g.steps, func(i, j int) bool { return g.steps[i].at < g.steps[j].at })
+	return g, nil
+}
+
+func (g stepGenerator) Next(tick GeneratorTick) float64 {
+	sinceMidnight := time.Duration(secondsIntoPeriod(tick.Now, 86400) * float64(time.Second))
+	// Before the first step of the day the last step of the previous day still applies
+	value := g.steps[len(g.steps)-1].value
+	for _, step := range g.steps {
+		if step.at > sinceMidnight {
+			break
+		}
+		value = step.value
+	}
+	return value * tick.Weight
+}
+
+// noiseGenerator adds gaussian noise to a profile-weighted baseline
+type noiseGenerator struct {
+	Baseline float64 `json:"baseline"`
+	StdDev   float64 `json:"stdDev"`
+}
+
+func (g noiseGenerator) Next(tick GeneratorTick) float64 {
+	return g.Baseline*tick.Weight + tick.Rand.NormFloat64()*g.StdDev
+}
+
+// holdGenerator keeps the last value, e.g. one set by a write-property downlink
+type holdGenerator struct{}
+
+func (holdGenerator) Next(tick GeneratorTick) float64 {
+	return tick.LastValue
+}
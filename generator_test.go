@@ -0,0 +1,126 @@
+package main
+
+import (
+	"math"
+	"math/rand/v2"
+	"testing"
+)
+
+func TestCounterGeneratorNext(t *testing.T) {
+	tests := []struct {
+		name      string
+		generator counterGenerator
+		lastValue float64
+		weight    float64
+		want      float64
+	}{
+		{"adds the increment", counterGenerator{Increment: 2}, 10, 1, 12},
+		{"scaled by the weight", counterGenerator{Increment: 2}, 10, 0.5, 11},
+		{"below the rollover limit", counterGenerator{Increment: 5, RolloverLimit: 100}, 90, 1, 95},
+		{"wraps past the rollover limit", counterGenerator{Increment: 5, RolloverLimit: 100}, 98, 1, 3},
+		{"wraps at exactly the rollover limit", counterGenerator{Increment: 5, RolloverLimit: 100}, 95, 1, 0},
+		{"reset probability 1 always resets", counterGenerator{Increment: 5, ResetProbability: 1}, 90, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.generator.Next(GeneratorTick{LastValue: tt.lastValue, Weight: tt.weight, Rand: rand.New(rand.NewPCG(1, 2))})
+			if got != tt.want {
+				t.Errorf("Next() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCounterGeneratorResetProbability(t *testing.T) {
+	const ticks = 10000
+	tests := []struct {
+		probability  float64
+		minResets    int
+		maxResets    int
+		wantMaxValue float64
+	}{
+		{0, 0, 0, ticks},
+		{0.1, 800, 1200, ticks},
+	}
+	for _, tt := range tests {
+		generator := counterGenerator{Increment: 1, ResetProbability: tt.probability}
+		rng := rand.New(rand.NewPCG(1, 2))
+		value, resets := 0.0, 0
+		for range ticks {
+			value = generator.Next(GeneratorTick{LastValue: value, Weight: 1, Rand: rng})
+			if value == 0 {
+				resets++
+			}
+		}
+		if resets < tt.minResets || resets > tt.maxResets {
+			t.Errorf("probability %v: %d resets in %d ticks, want %d..%d", tt.probability, resets, ticks, tt.minResets, tt.maxResets)
+		}
+		if tt.probability == 0 && value != tt.wantMaxValue {
+			t.Errorf("probability 0: value %v after %d ticks, want %v", value, ticks, tt.wantMaxValue)
+		}
+	}
+}
+
+// At 1e6 a 0.01 step is below one float32 ulp and would be lost; carried through
+// AccumulatedValue it still climbs, the way advance feeds it back each tick
+func TestCounterGeneratorKeepsPrecisionAcrossTicks(t *testing.T) {
+	const ticks = 100000
+	generator := counterGenerator{Increment: 0.01}
+	rng := rand.New(rand.NewPCG(1, 2))
+
+	var object WiredDeviceObject
+	object.setValue(1e6)
+	for range ticks {
+		object.setValue(generator.Next(GeneratorTick{LastValue: object.preciseValue(), Weight: 1, Rand: rng}))
+	}
+
+	want := 1e6 + ticks*0.01
+	if got := object.preciseValue(); math.Abs(got-want) > 1e-4 {
+		t.Errorf("preciseValue() = %v after %d ticks, want %v", got, ticks, want)
+	}
+	if object.ReportValue != float32(want) {
+		t.Errorf("ReportValue = %v, want %v", object.ReportValue, float32(want))
+	}
+}
+
+func TestPreciseValue(t *testing.T) {
+	tests := []struct {
+		name   string
+		object WiredDeviceObject
+		want   float64
+	}{
+		{"generated value", func() WiredDeviceObject {
+			var object WiredDeviceObject
+			object.setValue(16777216.25)
+			return object
+		}(), 16777216.25},
+		{"report value written since", func() WiredDeviceObject {
+			var object WiredDeviceObject
+			object.setValue(16777216.25)
+			object.ReportValue = 42
+			return object
+		}(), 42},
+		{"row predating the accumulated value", WiredDeviceObject{ReportValue: 7.5}, 7.5},
+		{"zero", WiredDeviceObject{}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.object.preciseValue(); got != tt.want {
+				t.Errorf("preciseValue() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetValue(t *testing.T) {
+	for _, value := range []float64{0, -3.5, 0.1, 16777217, 1e12 + 0.5} {
+		var object WiredDeviceObject
+		object.setValue(value)
+		if object.AccumulatedValue != value || object.ReportValue != float32(value) {
+			t.Errorf("setValue(%v) = %v / %v, want %v / %v", value, object.AccumulatedValue, object.ReportValue, value, float32(value))
+		}
+		if got := object.preciseValue(); got != value {
+			t.Errorf("preciseValue() after setValue(%v) = %v", value, got)
+		}
+	}
+}
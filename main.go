@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"math/rand/v2"
 	"os"
 	"os/signal"
 	"strconv"
@@ -22,6 +25,25 @@ type AppConfig struct {
 	MySqlPass string
 	ServerUrl string
 	Token     string
+
+	ReportBatchWindow    time.Duration
+	ReportBatchMaxFrames int
+
+	OutboxRetryInterval time.Duration
+	OutboxMaxAge        time.Duration
+
+	GatewayReconcileInterval time.Duration
+	ShutdownDrainTimeout     time.Duration
+
+	ReportWorkers int
+
+	// Same seed and start time give the same value sequence; zero SimStartTime starts at the real time.
+	// SimSeedFixed is set when SIM_SEED was given, generated values are then not saved.
+	SimSeed      uint64
+	SimSeedFixed bool
+	SimStartTime time.Time
+	SimSpeed     float64
+	Clock        Clock
 }
 
 type ControllerMaster struct {
@@ -33,6 +55,9 @@ type ControllerMaster struct {
 	Password       string    `json:"password"`
 	Token          string    `json:"token"`
 	LastHeartBeat  time.Time `json:"lastHeartbeat"`
+	// Sequence numbers are owned by seq.go and never written by saveControllerData
+	UplinkSeqId      int64 `json:"uplinkSeqId"`
+	AckedUplinkSeqId int64 `json:"ackedUplinkSeqId"`
 }
 
 var config AppConfig
@@ -47,6 +72,70 @@ func loadConfig() error {
 		return fmt.Errorf("invalid MYSQL_PORT in .env file: %w", err)
 	}
 
+	batchWindow, err := getEnvInt("REPORT_BATCH_WINDOW_SECONDS", 5)
+	if err != nil {
+		return err
+	}
+	if batchWindow <= 0 {
+		return fmt.Errorf("REPORT_BATCH_WINDOW_SECONDS must be positive, got %d", batchWindow)
+	}
+	batchMaxFrames, err := getEnvInt("REPORT_BATCH_MAX_FRAMES", 500)
+	if err != nil {
+		return err
+	}
+
+	outboxRetry, err := getEnvInt("OUTBOX_RETRY_SECONDS", 30)
+	if err != nil {
+		return err
+	}
+	outboxMaxAge, err := getEnvInt("OUTBOX_MAX_AGE_HOURS", 24)
+	if err != nil {
+		return err
+	}
+
+	reconcileInterval, err := getEnvInt("GATEWAY_RECONCILE_SECONDS", 30)
+	if err != nil {
+		return err
+	}
+	if reconcileInterval <= 0 {
+		return fmt.Errorf("GATEWAY_RECONCILE_SECONDS must be positive, got %d", reconcileInterval)
+	}
+
+	drainTimeout, err := getEnvInt("SHUTDOWN_DRAIN_SECONDS", 30)
+	if err != nil {
+		return err
+	}
+
+	reportWorkers, err := getEnvInt("REPORT_WORKERS", 16)
+	if err != nil {
+		return err
+	}
+	if reportWorkers <= 0 {
+		return fmt.Errorf("REPORT_WORKERS must be positive, got %d", reportWorkers)
+	}
+
+	simSeed := rand.Uint64()
+	simSeedFixed := false
+	if raw := os.Getenv("SIM_SEED"); raw != "" {
+		simSeedFixed = true
+		if simSeed, err = strconv.ParseUint(raw, 10, 64); err != nil {
+			return fmt.Errorf("invalid SIM_SEED in .env file: %w", err)
+		}
+	}
+	var simStartTime time.Time
+	if raw := os.Getenv("SIM_START_TIME"); raw != "" {
+		if simStartTime, err = time.Parse(time.RFC3339, raw); err != nil {
+			return fmt.Errorf("invalid SIM_START_TIME in .env file: %w", err)
+		}
+	}
+
+	simSpeed := 1.0
+	if raw := os.Getenv("SIM_SPEED"); raw != "" {
+		if simSpeed, err = strconv.ParseFloat(raw, 64); err != nil || simSpeed <= 0 {
+			return fmt.Errorf("invalid SIM_SPEED in .env file: %q", raw)
+		}
+	}
+
 	config = AppConfig{
 		MySqlHost: os.Getenv("MYSQL_HOST"),
 		MySqlPort: port,
@@ -54,6 +143,23 @@ func loadConfig() error {
 		MySqlUser: os.Getenv("MYSQL_USER"),
 		MySqlPass: os.Getenv("MYSQL_PASS"),
 		ServerUrl: os.Getenv("SERVER_URL"),
+
+		ReportBatchWindow:    time.Duration(batchWindow) * time.Second,
+		ReportBatchMaxFrames: batchMaxFrames,
+
+		OutboxRetryInterval: time.Duration(outboxRetry) * time.Second,
+		OutboxMaxAge:        time.Duration(outboxMaxAge) * time.Hour,
+
+		GatewayReconcileInterval: time.Duration(reconcileInterval) * time.Second,
+		ShutdownDrainTimeout:     time.Duration(drainTimeout) * time.Second,
+
+		ReportWorkers: reportWorkers,
+
+		SimSeed:      simSeed,
+		SimSeedFixed: simSeedFixed,
+		SimStartTime: simStartTime,
+		SimSpeed:     simSpeed,
+		Clock:        newSimulationClock(simStartTime, simSpeed),
 	}
 
 	log.WithFields(logrus.Fields{
@@ -65,6 +171,19 @@ func loadConfig() error {
 	return nil
 }
 
+// getEnvInt reads an optional integer from the environment
+func getEnvInt(key string, fallback int) (int, error) {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback, nil
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s in .env file: %w", key, err)
+	}
+	return value, nil
+}
+
 func initDatabase() (*gorm.DB, error) {
 	// Connect without database to create it if needed
 	dsnWithoutDb := fmt.Sprintf("%s:%s@tcp(%s:%d)/?charset=utf8mb4&parseTime=True&loc=Local",
@@ -98,7 +217,7 @@ func initDatabase() (*gorm.DB, error) {
 
 	// Auto-migrate tables
 	log.Info("Running auto-migration")
-	if err := db.AutoMigrate(&ControllerMaster{}, &WiredDeviceObject{}, &WiredObjectRules{}); err != nil {
+	if err := db.AutoMigrate(&ControllerMaster{}, &WiredDeviceObject{}, &WiredObjectRules{}, &UplinkOutbox{}, &LoadProfile{}, &FaultScenario{}); err != nil {
 		return nil, fmt.Errorf("failed to auto-migrate tables: %w", err)
 	}
 
@@ -108,30 +227,76 @@ func initDatabase() (*gorm.DB, error) {
 
 func init() {
 	initLogger()
+}
+
+func main() {
+	dumpSchema := flag.Bool("dump-schema", false, "print the TLV command/tag reference table and exit")
+	backfill := flag.Bool("backfill", false, "generate historical reports for a controller and exit")
+	backfillController := flag.Int("backfill-controller", 0, "id of the controller to backfill")
+	backfillObjects := flag.String("backfill-objects", "", "comma separated object ids to backfill, all objects when empty")
+	backfillFrom := flag.String("backfill-from", "", "start of the backfill range (RFC 3339)")
+	backfillTo := flag.String("backfill-to", "", "end of the backfill range (RFC 3339), now when empty")
+	backfillRate := flag.Float64("backfill-rate", 1, "maximum backfill uplinks per second")
+	flag.Parse()
+
+	if *dumpSchema {
+		if err := WriteSchemaReference(os.Stdout); err != nil {
+			log.WithError(err).Fatal("Failed to write schema reference")
+		}
+		return
+	}
+
+	var backfillRequest BackfillRequest
+	if *backfill {
+		var err error
+		backfillRequest, err = newBackfillRequest(*backfillController, *backfillObjects, *backfillFrom, *backfillTo, *backfillRate)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid backfill request")
+		}
+	}
 
 	if err := loadConfig(); err != nil {
 		log.WithError(err).Fatal("Failed to load configuration")
 	}
-}
 
-func main() {
 	log.Info("Starting connectx application")
 
 	db, err := initDatabase()
 	if err != nil {
 		log.WithError(err).Fatal("Failed to initialize database")
 	}
+	config.LoadProfiles(db)
 	config.LoadObjectRules(db)
+	config.LoadFaultScenarios(db)
+	config.startSimulation()
+
+	// Set up signal handling for graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	go config.StartGateWayOperation(db)
+	if *backfill {
+		if err := config.RunBackfill(ctx, backfillRequest, db); err != nil {
+			log.WithError(err).Fatal("Backfill failed")
+		}
+		return
+	}
 
-	log.Info("Application started successfully")
+	gatewayDone := make(chan struct{})
+	go func() {
+		defer close(gatewayDone)
+		config.StartGateWayOperation(ctx, db)
+	}()
 
-	// Set up signal handling for graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	log.Info("Application started successfully")
 
 	// Wait for interrupt signal
-	<-sigChan
-	log.Info("Shutdown signal received, exiting...")
+	<-ctx.Done()
+	log.WithField("drainTimeout", config.ShutdownDrainTimeout).Info("Shutdown signal received, draining gateway workers...")
+
+	select {
+	case <-gatewayDone:
+		log.Info("Gateway workers drained, exiting...")
+	case <-time.After(config.ShutdownDrainTimeout):
+		log.Warn("Drain timeout reached, exiting with workers still running...")
+	}
 }
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// UplinkOutbox holds encoded frames that could not be delivered, oldest first per controller.
+// Delivered rows were sent but not yet acknowledged; they are kept so a gap the server
+// reports can be replayed, and released once acked_uplink_seq_id reaches their seqId.
+type UplinkOutbox struct {
+	Id           uint64    `gorm:"primaryKey" json:"id"`
+	ControllerId int16     `gorm:"index" json:"controllerId"`
+	SeqId        int64     `json:"seqId"`
+	ReportFor    int       `json:"reportFor"`
+	Frames       []byte    `json:"frames"`
+	Attempts     int       `json:"attempts"`
+	LastError    string    `json:"lastError"`
+	Delivered    bool      `gorm:"index;not null;default:false" json:"delivered"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// maximum number of outbox rows loaded per replay round
+const outboxFlushLimit = 50
+
+// failed or gap replays after which an uplink is dropped; rate limited attempts do not count
+const outboxMaxAttempts = 20
+
+// outboxLocks serialises flushes per controller so rows are never sent twice
+var outboxLocks sync.Map
+
+func outboxLock(controllerId int16) *sync.Mutex {
+	lock, _ := outboxLocks.LoadOrStore(controllerId, &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
+
+// sendInOrder gives an uplink the next seqId and sends it, or queues it when older
+// uplinks are still in the outbox. The outbox lock is held from the allocation to the
+// send or enqueue, so no replay or other uplink of the controller can reach the server
+// in between and overtake the seqId. queued reports whether the uplink went to the outbox.
+func (appConfig AppConfig) sendInOrder(controller ControllerMaster, dataFromController map[int][]byte, db *gorm.DB) (queued bool, err error) {
+	lock := outboxLock(int16(controller.ControllerId))
+	lock.Lock()
+	defer lock.Unlock()
+
+	queued = appConfig.hasOutboxBacklog(controller, db)
+	seqId, err := appConfig.nextUplinkSeqId(controller, db)
+	if err != nil {
+		return queued, err
+	}
+	if queued {
+		return true, appConfig.enqueueOutbox(controller, seqId, dataFromController, nil, db)
+	}
+	log.WithFields(logrus.Fields{"controller": controller.MacAddress, "uplinkSeqId": seqId}).Info("Sending uplink")
+	return false, appConfig.deliverUplink(controller, seqId, dataFromController, db)
+}
+
+// deliverUplink sends an uplink, storing it in the outbox when the send fails and
+// keeping it when the server has not acknowledged it yet
+func (appConfig AppConfig) deliverUplink(controller ControllerMaster, seqId int64, dataFromController map[int][]byte, db *gorm.DB) error {
+	acked, err := appConfig.sendUplink(controller, seqId, dataFromController, db)
+	if err != nil {
+		if qErr := appConfig.enqueueOutbox(controller, seqId, dataFromController, err, db); qErr != nil {
+			return qErr
+		}
+		return err
+	}
+	if !acked {
+		return appConfig.storeOutbox(controller, seqId, dataFromController, nil, true, db)
+	}
+	return nil
+}
+
+// enqueueOutbox stores undelivered frames so they can be replayed later under the same seqId
+func (appConfig AppConfig) enqueueOutbox(controller ControllerMaster, seqId int64, dataFromController map[int][]byte, sendErr error, db *gorm.DB) error {
+	return appConfig.storeOutbox(controller, seqId, dataFromController, sendErr, false, db)
+}
+
+func (appConfig AppConfig) storeOutbox(controller ControllerMaster, seqId int64, dataFromController map[int][]byte, sendErr error, delivered bool, db *gorm.DB) error {
+	rows := make([]UplinkOutbox, 0, len(dataFromController))
+	for reportFor, frames := range dataFromController {
+		rows = append(rows, UplinkOutbox{
+			ControllerId: int16(controller.ControllerId),
+			SeqId:        seqId,
+			ReportFor:    reportFor,
+			Frames:       frames,
+			LastError:    errorString(sendErr),
+			Delivered:    delivered,
+		})
+	}
+	if err := db.Create(&rows).Error; err != nil {
+		return fmt.Errorf("failed to store uplink in outbox: %w", err)
+	}
+	fields := logrus.Fields{"controller": controller.MacAddress, "uplinkSeqId": seqId, "rows": len(rows)}
+	if delivered {
+		log.WithFields(fields).Info("Uplink kept until the server acknowledges it")
+	} else {
+		log.WithFields(fields).Warn("Uplink stored in outbox")
+	}
+	return nil
+}
+
+// releaseAckedUplinks deletes the kept uplinks an acknowledgement covers
+func (appConfig AppConfig) releaseAckedUplinks(controller ControllerMaster, ackId int64, db *gorm.DB) {
+	if err := db.Where("controller_id = ? AND delivered = ? AND seq_id <= ?", controller.ControllerId, true, ackId).Delete(&UplinkOutbox{}).Error; err != nil {
+		log.WithError(err).WithField("controller", controller.MacAddress).Error("Failed to release acknowledged uplinks")
+	}
+}
+
+// replayUplinkGap queues the kept uplinks between ackId and seqId for replay and
+// returns how many rows were queued. Uplinks the server keeps missing are dropped.
+func (appConfig AppConfig) replayUplinkGap(controller ControllerMaster, ackId int64, seqId int64, db *gorm.DB) int64 {
+	gap := db.Where("controller_id = ? AND delivered = ? AND seq_id > ? AND seq_id < ?", controller.ControllerId, true, ackId, seqId)
+
+	dropped := gap.Session(&gorm.Session{}).Where("attempts + 1 >= ?", outboxMaxAttempts).Delete(&UplinkOutbox{})
+	if dropped.Error != nil {
+		log.WithError(dropped.Error).WithField("controller", controller.MacAddress).Error("Failed to drop kept uplinks")
+	} else if dropped.RowsAffected > 0 {
+		log.WithFields(logrus.Fields{"controller": controller.MacAddress, "rows": dropped.RowsAffected}).Error("Dropping kept uplinks the server is still missing after too many replays")
+	}
+
+	queued := gap.Session(&gorm.Session{}).Model(&UplinkOutbox{}).Updates(map[string]interface{}{
+		"delivered": false,
+		"attempts":  gorm.Expr("attempts + 1"),
+	})
+	if queued.Error != nil {
+		log.WithError(queued.Error).WithField("controller", controller.MacAddress).Error("Failed to queue kept uplinks for replay")
+		return 0
+	}
+	return queued.RowsAffected
+}
+
+// hasOutboxBacklog reports whether the controller still has undelivered frames
+func (appConfig AppConfig) hasOutboxBacklog(controller ControllerMaster, db *gorm.DB) bool {
+	var count int64
+	if err := db.Model(&UplinkOutbox{}).Where("controller_id = ? AND delivered = ?", controller.ControllerId, false).Count(&count).Error; err != nil {
+		log.WithError(err).Error("Failed to count outbox rows")
+		return false
+	}
+	return count > 0
+}
+
+// flushOutbox replays the controller's backlog in order, dropping rows older than the max age
+// or that failed outboxMaxAttempts times. It stops at the first failure so later frames never
+// overtake earlier ones. Replayed uplinks the server does not acknowledge yet are kept.
+func (appConfig AppConfig) flushOutbox(controller ControllerMaster, db *gorm.DB) error {
+	lock := outboxLock(int16(controller.ControllerId))
+	lock.Lock()
+	defer lock.Unlock()
+
+	expired := db.Where("controller_id = ? AND created_at < ?", controller.ControllerId, time.Now().Add(-appConfig.OutboxMaxAge)).Delete(&UplinkOutbox{})
+	if expired.Error != nil {
+		return fmt.Errorf("failed to expire outbox rows: %w", expired.Error)
+	}
+	if expired.RowsAffected > 0 {
+		log.WithFields(logrus.Fields{"controller": controller.MacAddress, "rows": expired.RowsAffected}).Warn("Dropped expired outbox rows")
+	}
+
+	for {
+		var rows []UplinkOutbox
+		if err := db.Where("controller_id = ? AND delivered = ?", controller.ControllerId, false).Order("id").Limit(outboxFlushLimit).Find(&rows).Error; err != nil {
+			return fmt.Errorf("failed to load outbox rows: %w", err)
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+
+		// Each uplink is replayed with its original seqId so the server can spot duplicates
+		seqId := rows[0].SeqId
+		ids := make([]uint64, 0, len(rows))
+		dataFromController := make(map[int][]byte)
+		for _, row := range rows {
+			if row.SeqId != seqId {
+				break
+			}
+			ids = append(ids, row.Id)
+			dataFromController[row.ReportFor] = append(dataFromController[row.ReportFor], row.Frames...)
+		}
+
+		acked, err := appConfig.sendUplink(controller, seqId, dataFromController, db)
+		if err != nil {
+			if errors.Is(err, ErrRateLimited) {
+				db.Model(&UplinkOutbox{}).Where("id IN ?", ids).UpdateColumn("last_error", err.Error())
+				return fmt.Errorf("outbox replay of uplink %d failed: %w", seqId, err)
+			}
+			if rows[0].Attempts+1 < outboxMaxAttempts {
+				db.Model(&UplinkOutbox{}).Where("id IN ?", ids).Updates(map[string]interface{}{
+					"attempts":   gorm.Expr("attempts + 1"),
+					"last_error": err.Error(),
+				})
+				return fmt.Errorf("outbox replay of uplink %d failed: %w", seqId, err)
+			}
+			log.WithError(err).WithFields(logrus.Fields{"controller": controller.MacAddress, "uplinkSeqId": seqId, "rows": len(ids)}).Error("Dropping outbox uplink after too many attempts")
+			if err := db.Delete(&UplinkOutbox{}, ids).Error; err != nil {
+				return fmt.Errorf("failed to delete dropped outbox rows: %w", err)
+			}
+			continue
+		}
+
+		if !acked {
+			if err := db.Model(&UplinkOutbox{}).Where("id IN ?", ids).UpdateColumn("delivered", true).Error; err != nil {
+				return fmt.Errorf("failed to keep delivered outbox rows: %w", err)
+			}
+		} else if err := db.Delete(&UplinkOutbox{}, ids).Error; err != nil {
+			return fmt.Errorf("failed to delete delivered outbox rows: %w", err)
+		}
+		log.WithFields(logrus.Fields{"controller": controller.MacAddress, "uplinkSeqId": seqId, "rows": len(ids)}).Info("Outbox uplink delivered")
+	}
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
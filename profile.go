@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// LoadProfile holds hourly weights applied to a rule's increment or baseline.
+// Weekday, Weekend and Holiday are JSON arrays of 24 weights, Holidays a JSON
+// array of "2006-01-02" dates. Weekend and Holiday fall back to Weekday.
+type LoadProfile struct {
+	Id       uint16 `gorm:"primaryKey" json:"id"`
+	Name     string `gorm:"size:64" json:"name"`
+	Weekday  string `gorm:"type:text" json:"weekday"`
+	Weekend  string `gorm:"type:text" json:"weekend"`
+	Holiday  string `gorm:"type:text" json:"holiday"`
+	Holidays string `gorm:"type:text" json:"holidays"`
+}
+
+// loadProfile is the parsed form of a LoadProfile
+type loadProfile struct {
+	weekday  [24]float64
+	weekend  [24]float64
+	holiday  [24]float64
+	holidays map[string]bool
+}
+
+var loadProfiles = make(map[uint16]*loadProfile)
+
+func (appConfig AppConfig) LoadProfiles(db *gorm.DB) {
+	var profileList []LoadProfile
+	result := db.Find(&profileList)
+	if result.Error != nil && !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		log.Errorf("Error; %v", result.Error)
+	}
+	for _, profile := range profileList {
+		parsed, err := parseLoadProfile(profile)
+		if err != nil {
+			log.WithError(err).WithField("profile", profile.Name).Error("Invalid load profile, ignoring")
+			continue
+		}
+		loadProfiles[profile.Id] = parsed
+	}
+	log.WithFields(logrus.Fields{"profilesCount": len(loadProfiles)}).Info("Load profiles loaded to cache")
+}
+
+func parseLoadProfile(profile LoadProfile) (*loadProfile, error) {
+	if strings.TrimSpace(profile.Weekday) == "" {
+		return nil, fmt.Errorf("weekday weights are required")
+	}
+	parsed := &loadProfile{holidays: make(map[string]bool)}
+	if err := parseHourlyWeights(profile.Weekday, &parsed.weekday); err != nil {
+		return nil, fmt.Errorf("weekday: %w", err)
+	}
+	parsed.weekend, parsed.holiday = parsed.weekday, parsed.weekday
+	if err := parseHourlyWeights(profile.Weekend, &parsed.weekend); err != nil {
+		return nil, fmt.Errorf("weekend: %w", err)
+	}
+	if err := parseHourlyWeights(profile.Holiday, &parsed.holiday); err != nil {
+		return nil, fmt.Errorf("holiday: %w", err)
+	}
+
+	if strings.TrimSpace(profile.Holidays) != "" {
+		var dates []string
+		if err := json.Unmarshal([]byte(profile.Holidays), &dates); err != nil {
+			return nil, fmt.Errorf("holidays: %w", err)
+		}
+		for _, date := range dates {
+			if _, err := time.Parse(time.DateOnly, date); err != nil {
+				return nil, fmt.Errorf("holidays: %w", err)
+			}
+			parsed.holidays[date] = true
+		}
+	}
+	return parsed, nil
+}
+
+// parseHourlyWeights fills weights from a JSON array of 24 numbers, leaving it untouched when raw is empty
+func parseHourlyWeights(raw string, weights *[24]float64) error {
+	if strings.TrimSpace(raw) == "" {
+		return nil
+	}
+	var values []float64
+	if err := json.Unmarshal([]byte(raw), &values); err != nil {
+		return err
+	}
+	if len(values) != len(weights) {
+		return fmt.Errorf("need %d hourly weights, got %d", len(weights), len(values))
+	}
+	copy(weights[:], values)
+	return nil
+}
+
+// dayWeights picks the weights that apply on the day of t
+func (p *loadProfile) dayWeights(t time.Time) *[24]float64 {
+	if p.holidays[t.Format(time.DateOnly)] {
+		return &p.holiday
+	}
+	if t.Weekday() == time.Saturday || t.Weekday() == time.Sunday {
+		return &p.weekend
+	}
+	return &p.weekday
+}
+
+// weight interpolates linearly between the hourly weights around t, carrying into the next day at 23:00
+func (p *loadProfile) weight(t time.Time) float64 {
+	hour := t.Hour()
+	fraction := (float64(t.Minute())*60 + float64(t.Second())) / 3600
+
+	current := p.dayWeights(t)[hour]
+	next := t.Add(time.Hour)
+	following := p.dayWeights(next)[next.Hour()]
+	return current + (following-current)*fraction
+}
+
+// profileWeight is the load profile weight of a rule at t, or 1 when the rule has no profile
+func profileWeight(rule WiredObjectRules, t time.Time) float64 {
+	if rule.LoadProfileId == 0 {
+		return 1
+	}
+	profile, ok := loadProfiles[rule.LoadProfileId]
+	if !ok {
+		return 1
+	}
+	return profile.weight(t)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// A controller reports isRebooted=true until one sync of its current boot
+// generation succeeds. Every controller starts in generation 1 when the
+// process starts, and a simulated reboot moves it to the next generation.
+var (
+	bootMu            sync.Mutex
+	bootGenerations   = map[int16]uint64{}
+	syncedGenerations = map[int16]uint64{}
+)
+
+func init() {
+	RegisterDownlinkHandler(CommandReboot, handleReboot)
+}
+
+// rebootStatus returns the controller's boot generation and whether it has not yet synced in it
+func rebootStatus(controller ControllerMaster) (uint64, bool) {
+	bootMu.Lock()
+	defer bootMu.Unlock()
+
+	generation, ok := bootGenerations[controller.Id]
+	if !ok {
+		generation = 1
+		bootGenerations[controller.Id] = generation
+	}
+	return generation, syncedGenerations[controller.Id] < generation
+}
+
+// markSynced records that the server has seen the given boot generation
+func markSynced(controller ControllerMaster, generation uint64) {
+	bootMu.Lock()
+	defer bootMu.Unlock()
+
+	if syncedGenerations[controller.Id] < generation {
+		syncedGenerations[controller.Id] = generation
+	}
+}
+
+// simulateReboot puts the controller through a restart: the next sync reports
+// isRebooted=true, sequence numbers start again and learned clock offsets are lost.
+// Buffered outbox frames survive, like a gateway's flash storage, and take the first
+// sequence numbers of the new boot so their replay stays in order.
+func (appConfig AppConfig) simulateReboot(controller ControllerMaster, db *gorm.DB) error {
+	bootMu.Lock()
+	generation, ok := bootGenerations[controller.Id]
+	if !ok {
+		generation = 1
+	}
+	bootGenerations[controller.Id] = generation + 1
+	bootMu.Unlock()
+
+	clockOffsets.Delete(controller.Id)
+
+	// Lock order matches sendInOrder, which allocates a seqId while holding the outbox lock
+	lock := outboxLock(int16(controller.ControllerId))
+	lock.Lock()
+	seqLock.Lock()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var rows []UplinkOutbox
+		if err := tx.Select("id", "seq_id").Where("controller_id = ?", controller.ControllerId).Order("id").Find(&rows).Error; err != nil {
+			return err
+		}
+		// Rows of one uplink share a seqId and keep sharing the new one
+		seqId, previous := int64(0), int64(-1)
+		for _, row := range rows {
+			if seqId == 0 || row.SeqId != previous {
+				seqId++
+				previous = row.SeqId
+			}
+			// Uplinks kept for an acknowledgement of the old boot are sent again
+			if err := tx.Model(&UplinkOutbox{}).Where("id = ?", row.Id).UpdateColumns(map[string]interface{}{"seq_id": seqId, "delivered": false}).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(&ControllerMaster{}).Where("id = ?", controller.Id).UpdateColumns(map[string]interface{}{
+			"uplink_seq_id":       seqId,
+			"acked_uplink_seq_id": 0,
+		}).Error
+	})
+	seqLock.Unlock()
+	lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(logrus.Fields{"controller": controller.MacAddress, "bootGeneration": generation + 1}).Warn("Controller rebooted")
+	return nil
+}
+
+func handleReboot(appConfig AppConfig, controller ControllerMaster, frame *TagVO, db *gorm.DB) error {
+	return appConfig.simulateReboot(controller, db)
+}
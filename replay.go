@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/format"
+)
+
+// replayParams configure a replay generator, e.g. {"file":"trends/ahu1.csv","speed":60,"loop":true};
+// the file is CSV, or Parquet when its name ends in .parquet
+type replayParams struct {
+	File        string  `json:"file"`
+	Speed       float64 `json:"speed"`
+	Loop        bool    `json:"loop"`
+	Interpolate bool    `json:"interpolate"`
+	ShiftToNow  *bool   `json:"shiftToNow"`
+}
+
+type replaySample struct {
+	at    time.Time
+	value float64
+}
+
+type replayKey struct {
+	DeviceId uint32
+	ObjectId uint32
+}
+
+// replayGenerator maps simulated time onto a recording. With ShiftToNow (the
+// default) the start of the recording lines up with the start of the
+// simulation; without it the recording's own timestamps are used, which suits
+// runs started with SIM_START_TIME inside the recorded period. Past the end of
+// the recording it loops or holds the last sample; objects missing from the
+// file hold their value.
+type replayGenerator struct {
+	series      map[replayKey][]replaySample
+	start       time.Time
+	end         time.Time
+	speed       float64
+	loop        bool
+	interpolate bool
+	shiftToNow  bool
+}
+
+func newReplayGenerator(params replayParams) (ValueGenerator, error) {
+	if params.File == "" {
+		return nil, fmt.Errorf("replay needs a file")
+	}
+	if params.Speed == 0 {
+		params.Speed = 1
+	}
+	if params.Speed < 0 {
+		return nil, fmt.Errorf("replay speed must be positive, got %v", params.Speed)
+	}
+	series, err := readReplayFile(params.File)
+	if err != nil {
+		return nil, err
+	}
+	g := replayGenerator{
+		series:      series,
+		speed:       params.Speed,
+		loop:        params.Loop,
+		interpolate: params.Interpolate,
+		shiftToNow:  params.ShiftToNow == nil || *params.ShiftToNow,
+	}
+	for _, samples := range series {
+		if g.start.IsZero() || samples[0].at.Before(g.start) {
+			g.start = samples[0].at
+		}
+		if last := samples[len(samples)-1].at; last.After(g.end) {
+			g.end = last
+		}
+	}
+	return g, nil
+}
+
+// readReplayFile reads the samples of a recording with deviceId, objectId,
+// timestamp and value columns; rows may come in any order
+func readReplayFile(path string) (map[replayKey][]replaySample, error) {
+	read := readReplayCSV
+	if strings.EqualFold(filepath.Ext(path), ".parquet") {
+		read = readReplayParquet
+	}
+	series, err := read(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(series) == 0 {
+		return nil, fmt.Errorf("%s: no samples", path)
+	}
+
+	for _, samples := range series {
+		sort.SliceStable(samples, func(i, j int) bool { return samples[i].at.Before(samples[j].at) })
+	}
+	return series, nil
+}
+
+// readReplayCSV reads a CSV with a deviceId,objectId,timestamp,value header.
+// Timestamps are RFC 3339 or unix seconds.
+func readReplayCSV(path string) (map[replayKey][]replaySample, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, name := range []string{"deviceId", "objectId", "timestamp", "value"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("%s: missing column %q", path, name)
+		}
+	}
+
+	series := make(map[replayKey][]replaySample)
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		deviceId, err := strconv.ParseUint(record[columns["deviceId"]], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: invalid deviceId: %w", path, line, err)
+		}
+		objectId, err := strconv.ParseUint(record[columns["objectId"]], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: invalid objectId: %w", path, line, err)
+		}
+		at, err := parseReplayTimestamp(record[columns["timestamp"]])
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: invalid timestamp: %w", path, line, err)
+		}
+		value, err := strconv.ParseFloat(record[columns["value"]], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: invalid value: %w", path, line, err)
+		}
+		key := replayKey{uint32(deviceId), uint32(objectId)}
+		series[key] = append(series[key], replaySample{at: at, value: value})
+	}
+	return series, nil
+}
+
+// readReplayParquet reads a Parquet file with deviceId, objectId, timestamp and
+// value columns of any numeric type. Timestamps are TIMESTAMP columns, integer
+// unix seconds or RFC 3339 strings; values may also be numeric strings.
+func readReplayParquet(path string) (map[replayKey][]replaySample, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	parquetFile, err := parquet.OpenFile(file, info.Size())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	columns := make(map[string]parquet.LeafColumn)
+	for _, name := range []string{"deviceId", "objectId", "timestamp", "value"} {
+		leaf, ok := parquetFile.Schema().Lookup(name)
+		if !ok {
+			return nil, fmt.Errorf("%s: missing column %q", path, name)
+		}
+		columns[name] = leaf
+	}
+	// Timestamps without a TIMESTAMP annotation are unix seconds
+	timestampUnit := time.Second
+	if logicalType := columns["timestamp"].Node.Type().LogicalType(); logicalType != nil {
+		if timestampType, ok := logicalType.Value.(*format.TimestampType); ok {
+			timestampUnit = timestampType.Unit.Value.Duration()
+		}
+	}
+
+	reader := parquet.NewReader(parquetFile)
+	defer reader.Close()
+
+	series := make(map[replayKey][]replaySample)
+	rows := make([]parquet.Row, 256)
+	values := make(map[int]parquet.Value)
+	for index := 0; ; {
+		n, err := reader.ReadRows(rows)
+		for _, row := range rows[:n] {
+			index++
+			clear(values)
+			for _, value := range row {
+				values[value.Column()] = value
+			}
+			column := func(name string) parquet.Value { return values[columns[name].ColumnIndex] }
+
+			deviceId, err := parquetUint32(column("deviceId"))
+			if err != nil {
+				return nil, fmt.Errorf("%s row %d: invalid deviceId: %w", path, index, err)
+			}
+			objectId, err := parquetUint32(column("objectId"))
+			if err != nil {
+				return nil, fmt.Errorf("%s row %d: invalid objectId: %w", path, index, err)
+			}
+			at, err := parquetTimestamp(column("timestamp"), timestampUnit)
+			if err != nil {
+				return nil, fmt.Errorf("%s row %d: invalid timestamp: %w", path, index, err)
+			}
+			value, err := parquetFloat(column("value"))
+			if err != nil {
+				return nil, fmt.Errorf("%s row %d: invalid value: %w", path, index, err)
+			}
+			key := replayKey{deviceId, objectId}
+			series[key] = append(series[key], replaySample{at: at, value: value})
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return series, nil
+}
+
+func parquetFloat(value parquet.Value) (float64, error) {
+	switch value.Kind() {
+	case parquet.Boolean:
+		if value.Boolean() {
+			return 1, nil
+		}
+		return 0, nil
+	case parquet.Int32:
+		return float64(value.Int32()), nil
+	case parquet.Int64:
+		return float64(value.Int64()), nil
+	case parquet.Float:
+		return float64(value.Float()), nil
+	case parquet.Double:
+		return value.Double(), nil
+	case parquet.ByteArray:
+		return strconv.ParseFloat(string(value.ByteArray()), 64)
+	}
+	if value.IsNull() {
+		return 0, fmt.Errorf("missing")
+	}
+	return 0, fmt.Errorf("unsupported type %s", value.Kind())
+}
+
+func parquetUint32(value parquet.Value) (uint32, error) {
+	switch value.Kind() {
+	case parquet.Int32, parquet.Int64:
+		if id := value.Int64(); id >= 0 && id <= math.MaxUint32 {
+			return uint32(id), nil
+		}
+		return 0, fmt.Errorf("%d out of range", value.Int64())
+	case parquet.ByteArray:
+		id, err := strconv.ParseUint(string(value.ByteArray()), 10, 32)
+		return uint32(id), err
+	}
+	if value.IsNull() {
+		return 0, fmt.Errorf("missing")
+	}
+	return 0, fmt.Errorf("unsupported type %s", value.Kind())
+}
+
+func parquetTimestamp(value parquet.Value, unit time.Duration) (time.Time, error) {
+	switch value.Kind() {
+	case parquet.Int32, parquet.Int64:
+		return time.Unix(0, 0).Add(time.Duration(value.Int64()) * unit), nil
+	case parquet.ByteArray:
+		return parseReplayTimestamp(string(value.ByteArray()))
+	}
+	if value.IsNull() {
+		return time.Time{}, fmt.Errorf("missing")
+	}
+	return time.Time{}, fmt.Errorf("unsupported type %s", value.Kind())
+}
+
+func parseReplayTimestamp(raw string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, raw)
+}
+
+// position is the point of the recording played at simulated time now
+func (g replayGenerator) position(now time.Time) time.Time {
+	anchor := simulationEpoch
+	origin := anchor
+	if g.shiftToNow {
+		origin = g.start
+	}
+	position := origin.Add(time.Duration(float64(now.Sub(anchor)) * g.speed))
+
+	span := g.end.Sub(g.start)
+	if g.loop && span > 0 && position.After(g.end) {
+		position = g.start.Add(position.Sub(g.start) % span)
+	}
+	return position
+}
+
+func (g replayGenerator) Next(tick GeneratorTick) float64 {
+	samples, ok := g.series[replayKey{tick.DeviceId, tick.ObjectId}]
+	if !ok {
+		return tick.LastValue
+	}
+	position := g.position(tick.Now)
+
+	// index of the first sample after position
+	i := sort.Search(len(samples), func(i int) bool { return samples[i].at.After(position) })
+	switch {
+	case i == 0:
+		return samples[0].value
+	case i == len(samples):
+		return samples[len(samples)-1].value
+	}
+	previous, next := samples[i-1], samples[i]
+	if !g.interpolate {
+		return previous.value
+	}
+	fraction := float64(position.Sub(previous.at)) / float64(next.at.Sub(previous.at))
+	return previous.value + (next.value-previous.value)*fraction
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// the recording every replay file in these tests holds, out of order
+var replayTestSamples = []struct {
+	deviceId, objectId uint32
+	at                 time.Time
+	value              float64
+}{
+	{10, 1, testEpoch.Add(time.Minute), 21.5},
+	{10, 1, testEpoch, 20},
+	{10, 2, testEpoch, -3},
+	{11, 1, testEpoch.Add(30 * time.Second), 1e6},
+}
+
+func writeReplayParquet[T any](t *testing.T, convert func(deviceId, objectId uint32, at time.Time, value float64) T) string {
+	t.Helper()
+	rows := make([]T, 0, len(replayTestSamples))
+	for _, sample := range replayTestSamples {
+		rows = append(rows, convert(sample.deviceId, sample.objectId, sample.at, sample.value))
+	}
+	path := filepath.Join(t.TempDir(), "trend.parquet")
+	if err := parquet.WriteFile(path, rows); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+type unixSecondsRow struct {
+	DeviceId  int64   `parquet:"deviceId"`
+	ObjectId  int64   `parquet:"objectId"`
+	Timestamp int64   `parquet:"timestamp"`
+	Value     float64 `parquet:"value"`
+}
+
+type timestampRow struct {
+	DeviceId  int32   `parquet:"deviceId"`
+	ObjectId  int32   `parquet:"objectId"`
+	Timestamp int64   `parquet:"timestamp,timestamp(millisecond)"`
+	Value     float32 `parquet:"value"`
+}
+
+type stringRow struct {
+	DeviceId  string `parquet:"deviceId"`
+	ObjectId  string `parquet:"objectId"`
+	Timestamp string `parquet:"timestamp"`
+	Value     string `parquet:"value"`
+}
+
+type missingValueRow struct {
+	DeviceId  int64 `parquet:"deviceId"`
+	ObjectId  int64 `parquet:"objectId"`
+	Timestamp int64 `parquet:"timestamp"`
+}
+
+func TestReadReplayFile(t *testing.T) {
+	csvPath := filepath.Join(t.TempDir(), "trend.csv")
+	csv := "deviceId,objectId,timestamp,value\n"
+	for _, sample := range replayTestSamples {
+		csv += fmt.Sprintf("%d,%d,%s,%v\n", sample.deviceId, sample.objectId, sample.at.Format(time.RFC3339), sample.value)
+	}
+	if err := os.WriteFile(csvPath, []byte(csv), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+	}{
+		{"csv", csvPath},
+		{"parquet unix seconds", writeReplayParquet(t, func(deviceId, objectId uint32, at time.Time, value float64) unixSecondsRow {
+			return unixSecondsRow{int64(deviceId), int64(objectId), at.Unix(), value}
+		})},
+		{"parquet timestamp", writeReplayParquet(t, func(deviceId, objectId uint32, at time.Time, value float64) timestampRow {
+			return timestampRow{int32(deviceId), int32(objectId), at.UnixMilli(), float32(value)}
+		})},
+		{"parquet strings", writeReplayParquet(t, func(deviceId, objectId uint32, at time.Time, value float64) stringRow {
+			return stringRow{fmt.Sprint(deviceId), fmt.Sprint(objectId), at.Format(time.RFC3339), fmt.Sprint(value)}
+		})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			series, err := readReplayFile(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[replayKey][]replaySample{
+				{10, 1}: {{testEpoch, 20}, {testEpoch.Add(time.Minute), 21.5}},
+				{10, 2}: {{testEpoch, -3}},
+				{11, 1}: {{testEpoch.Add(30 * time.Second), 1e6}},
+			}
+			if len(series) != len(want) {
+				t.Fatalf("got %d series, want %d", len(series), len(want))
+			}
+			for key, samples := range want {
+				got := series[key]
+				if len(got) != len(samples) {
+					t.Errorf("%v: got %d samples, want %d", key, len(got), len(samples))
+					continue
+				}
+				for i := range samples {
+					if !got[i].at.Equal(samples[i].at) || got[i].value != samples[i].value {
+						t.Errorf("%v sample %d = %s %v, want %s %v", key, i, got[i].at, got[i].value, samples[i].at, samples[i].value)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestReadReplayParquetMissingColumn(t *testing.T) {
+	path := writeReplayParquet(t, func(deviceId, objectId uint32, at time.Time, value float64) missingValueRow {
+		return missingValueRow{int64(deviceId), int64(objectId), at.Unix()}
+	})
+	if _, err := readReplayFile(path); err == nil {
+		t.Error("reading a file without a value column succeeded, want an error")
+	}
+}
+
+func TestReplayGeneratorNextAcrossLoop(t *testing.T) {
+	previousEpoch := simulationEpoch
+	simulationEpoch = testEpoch
+	defer func() { simulationEpoch = previousEpoch }()
+
+	// 20 minutes of recording: 10, 20 and 40 at ten minute steps
+	recording := func(start time.Time) map[replayKey][]replaySample {
+		return map[replayKey][]replaySample{{10, 1}: {
+			{start, 10},
+			{start.Add(10 * time.Minute), 20},
+			{start.Add(20 * time.Minute), 40},
+		}}
+	}
+	recordedAt := time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)
+	inRun := testEpoch.Add(time.Hour)
+
+	tests := []struct {
+		name        string
+		start       time.Time
+		shiftToNow  bool
+		loop        bool
+		interpolate bool
+		speed       float64
+		now         time.Duration
+		want        float64
+	}{
+		{"shifted, inside the first pass", recordedAt, true, true, false, 1, 5 * time.Minute, 10},
+		{"shifted, interpolated inside the first pass", recordedAt, true, true, true, 1, 5 * time.Minute, 15},
+		{"shifted, at the end", recordedAt, true, true, true, 1, 20 * time.Minute, 40},
+		{"shifted, just past the end wraps", recordedAt, true, true, false, 1, 20*time.Minute + time.Second, 10},
+		{"shifted, interpolated past the end wraps", recordedAt, true, true, true, 1, 25 * time.Minute, 15},
+		{"shifted, two spans in is the start", recordedAt, true, true, true, 1, 40 * time.Minute, 10},
+		{"shifted, interpolated in the third pass", recordedAt, true, true, true, 1, 55 * time.Minute, 30},
+		{"shifted, no loop holds the last sample", recordedAt, true, false, true, 1, 25 * time.Minute, 40},
+		{"shifted, sped up wraps sooner", recordedAt, true, true, false, 2, 15 * time.Minute, 20},
+		{"own timestamps, before the recording", inRun, false, true, true, 1, 30 * time.Minute, 10},
+		{"own timestamps, interpolated inside", inRun, false, true, true, 1, 65 * time.Minute, 15},
+		{"own timestamps, past the end wraps", inRun, false, true, false, 1, 85 * time.Minute, 10},
+		{"own timestamps, interpolated past the end wraps", inRun, false, true, true, 1, 95 * time.Minute, 30},
+		{"own timestamps, no loop holds the last sample", inRun, false, false, false, 1, 95 * time.Minute, 40},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := replayGenerator{
+				series:      recording(tt.start),
+				start:       tt.start,
+				end:         tt.start.Add(20 * time.Minute),
+				speed:       tt.speed,
+				loop:        tt.loop,
+				interpolate: tt.interpolate,
+				shiftToNow:  tt.shiftToNow,
+			}
+			got := g.Next(GeneratorTick{DeviceId: 10, ObjectId: 1, Now: testEpoch.Add(tt.now), LastValue: -1})
+			if got != tt.want {
+				t.Errorf("Next() at +%v = %v, want %v", tt.now, got, tt.want)
+			}
+		})
+	}
+}
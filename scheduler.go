@@ -0,0 +1,254 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// report interval of objects whose object and rule leave it unset
+const defaultReportInterval = 30 * time.Second
+
+// scheduledObject is one object in the report schedule
+type scheduledObject struct {
+	ctx      context.Context
+	batcher  *ReportBatcher
+	live     *liveObject
+	key      objectKey
+	interval time.Duration
+	nextDue  time.Time
+
+	index    int // position in the heap, -1 while dispatched or removed
+	removed  bool
+	inFlight *sync.WaitGroup
+}
+
+// scheduleHeap orders objects by their next due time
+type scheduleHeap []*scheduledObject
+
+func (h scheduleHeap) Len() int           { return len(h) }
+func (h scheduleHeap) Less(i, j int) bool { return h[i].nextDue.Before(h[j].nextDue) }
+func (h scheduleHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *scheduleHeap) Push(x any) {
+	entry := x.(*scheduledObject)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *scheduleHeap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	entry.index = -1
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// ReportScheduler fires object reports from a single min-heap of due times and
+// runs them on a fixed-size worker pool, so the number of goroutines does not
+// grow with the number of points.
+type ReportScheduler struct {
+	appConfig AppConfig
+	db        *gorm.DB
+	workers   int
+
+	mu         sync.Mutex
+	queue      scheduleHeap
+	entries    map[objectKey]*scheduledObject
+	inFlight   map[int16]*sync.WaitGroup
+	wake       chan struct{}
+	dispatched chan *scheduledObject
+}
+
+func (appConfig AppConfig) NewReportScheduler(db *gorm.DB) *ReportScheduler {
+	return &ReportScheduler{
+		appConfig:  appConfig,
+		db:         db,
+		workers:    appConfig.ReportWorkers,
+		entries:    make(map[objectKey]*scheduledObject),
+		inFlight:   make(map[int16]*sync.WaitGroup),
+		wake:       make(chan struct{}, 1),
+		dispatched: make(chan *scheduledObject),
+	}
+}
+
+// spreadOffset places an object at a stable point inside its interval so that
+// objects sharing an interval do not all fire in the same burst
+func spreadOffset(key objectKey, interval time.Duration) time.Duration {
+	if interval <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	var buf [6]byte
+	buf[0], buf[1] = byte(key.ControllerId>>8), byte(key.ControllerId)
+	buf[2], buf[3], buf[4], buf[5] = byte(key.ObjectId>>24), byte(key.ObjectId>>16), byte(key.ObjectId>>8), byte(key.ObjectId)
+	h.Write(buf[:])
+	return time.Duration(h.Sum64() % uint64(interval))
+}
+
+// Add schedules an object of a controller worker; ctx is that worker's context
+func (s *ReportScheduler) Add(ctx context.Context, batcher *ReportBatcher, live *liveObject) {
+	live.mu.Lock()
+	key := objectKey{live.object.ControllerId, live.object.ObjectId}
+	interval := reportInterval(live.object)
+	live.mu.Unlock()
+
+	s.mu.Lock()
+	if previous, ok := s.entries[key]; ok {
+		s.removeLocked(previous)
+	}
+	group, ok := s.inFlight[key.ControllerId]
+	if !ok {
+		group = &sync.WaitGroup{}
+		s.inFlight[key.ControllerId] = group
+	}
+	entry := &scheduledObject{
+		ctx:      ctx,
+		batcher:  batcher,
+		live:     live,
+		key:      key,
+		interval: interval,
+		nextDue:  firstReportSlot(key, interval, s.appConfig.clock().Now()),
+		inFlight: group,
+	}
+	s.entries[key] = entry
+	heap.Push(&s.queue, entry)
+	s.mu.Unlock()
+
+	s.notify()
+}
+
+// RemoveController unschedules every object of a controller and waits for
+// reports already handed to the pool to finish. It returns the removed objects.
+func (s *ReportScheduler) RemoveController(controllerId int16) []*liveObject {
+	s.mu.Lock()
+	var removed []*liveObject
+	for key, entry := range s.entries {
+		if key.ControllerId == controllerId {
+			s.removeLocked(entry)
+			removed = append(removed, entry.live)
+		}
+	}
+	group := s.inFlight[controllerId]
+	s.mu.Unlock()
+
+	if group != nil {
+		group.Wait()
+	}
+	return removed
+}
+
+func (s *ReportScheduler) removeLocked(entry *scheduledObject) {
+	entry.removed = true
+	if entry.index >= 0 {
+		heap.Remove(&s.queue, entry.index)
+	}
+	if s.entries[entry.key] == entry {
+		delete(s.entries, entry.key)
+	}
+}
+
+func (s *ReportScheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run starts the worker pool and dispatches due objects until ctx is cancelled
+func (s *ReportScheduler) Run(ctx context.Context) {
+	log.WithField("workers", s.workers).Info("Starting report scheduler")
+
+	var pool sync.WaitGroup
+	for i := 0; i < s.workers; i++ {
+		pool.Add(1)
+		go func() {
+			defer pool.Done()
+			s.work(ctx)
+		}()
+	}
+	defer pool.Wait()
+
+	clock := s.appConfig.clock()
+	timer := clock.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		s.mu.Lock()
+		wait := time.Hour
+		var due *scheduledObject
+		if len(s.queue) > 0 {
+			if wait = s.queue[0].nextDue.Sub(clock.Now()); wait <= 0 {
+				due = heap.Pop(&s.queue).(*scheduledObject)
+				due.inFlight.Add(1)
+			}
+		}
+		s.mu.Unlock()
+
+		if due != nil {
+			select {
+			case s.dispatched <- due:
+			case <-ctx.Done():
+				due.inFlight.Done()
+				return
+			}
+			continue
+		}
+
+		timer.Reset(wait)
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+		case <-timer.C():
+		}
+	}
+}
+
+func (s *ReportScheduler) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case entry := <-s.dispatched:
+			if entry.ctx.Err() == nil {
+				s.appConfig.generateReportForObject(entry.batcher, entry.live, entry.nextDue, s.db)
+			}
+			s.reschedule(entry)
+			entry.inFlight.Done()
+		}
+	}
+}
+
+// reschedule puts an object back on the heap one interval after its last due time.
+// The interval is re-read so downlink config changes apply from the next report.
+// Slots missed while the pool was saturated are still generated, late, so the value
+// sequence does not depend on load.
+func (s *ReportScheduler) reschedule(entry *scheduledObject) {
+	entry.live.mu.Lock()
+	interval := reportInterval(entry.live.object)
+	entry.live.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry.removed || entry.ctx.Err() != nil {
+		return
+	}
+	entry.interval = interval
+
+	entry.nextDue = entry.nextDue.Add(entry.interval)
+	if now := s.appConfig.clock().Now(); entry.nextDue.Before(now) {
+		log.WithFields(logrus.Fields{"objectId": entry.key.ObjectId, "behind": now.Sub(entry.nextDue)}).Debug("Report scheduler is behind, catching up")
+	}
+	heap.Push(&s.queue, entry)
+	s.notify()
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"testing"
+	"time"
+)
+
+// reportTimestamps decodes the timestamps of the report frames queued in a batcher
+func reportTimestamps(t *testing.T, batcher *ReportBatcher) []time.Time {
+	t.Helper()
+	batcher.mu.Lock()
+	data := append([]byte(nil), batcher.pending[1]...)
+	batcher.mu.Unlock()
+
+	frames, err := ParseRequestMessages(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamps := make([]time.Time, 0, len(frames))
+	for _, frame := range frames {
+		timestamp, err := frame.GetIntValue(TagTimestamp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		timestamps = append(timestamps, time.Unix(int64(timestamp), 0).UTC())
+	}
+	return timestamps
+}
+
+func TestReportSchedulerCatchesUpMissedSlots(t *testing.T) {
+	previousEpoch := simulationEpoch
+	simulationEpoch = testEpoch
+	defer func() { simulationEpoch = previousEpoch }()
+
+	clock := NewManualClock(testEpoch)
+	appConfig := AppConfig{Clock: clock, ReportWorkers: 2, SimSeedFixed: true}
+	db := newTestDB(t)
+	scheduler := appConfig.NewReportScheduler(db)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go scheduler.Run(ctx)
+
+	object := WiredDeviceObject{ObjectId: 7, ControllerId: 1, ReportIntervalSeconds: 10}
+	live := &liveObject{object: object, rng: objectRand(object.ControllerId, object.ObjectId)}
+	batcher := appConfig.NewReportBatcher(ControllerMaster{Id: 1}, db)
+	scheduler.Add(ctx, batcher, live)
+
+	interval := 10 * time.Second
+	first := testEpoch.Add(spreadOffset(objectKey{1, 7}, interval))
+	waitForTimer(t, clock, first)
+
+	// One large step leaves several slots behind; each is generated, none skipped
+	clock.Advance(35 * time.Second)
+	var want []time.Time
+	for slot := first; !slot.After(clock.Now()); slot = slot.Add(interval) {
+		want = append(want, slot.Truncate(time.Second))
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	var got []time.Time
+	for time.Now().Before(deadline) {
+		if got = reportTimestamps(t, batcher); len(got) >= len(want) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d reports, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !got[i].Equal(want[i]) {
+			t.Errorf("report %d stamped %s, want %s", i, got[i], want[i])
+		}
+	}
+}
+
+func TestScheduleHeapOrder(t *testing.T) {
+	offsets := []time.Duration{30, 5, 20, 5, 0, 45, 10}
+	var queue scheduleHeap
+	entries := make([]*scheduledObject, len(offsets))
+	for i, offset := range offsets {
+		entries[i] = &scheduledObject{key: objectKey{1, uint32(i)}, nextDue: testEpoch.Add(offset * time.Second)}
+		heap.Push(&queue, entries[i])
+	}
+
+	// Removing an entry from the middle keeps the heap ordered
+	heap.Remove(&queue, entries[2].index)
+	if entries[2].index != -1 {
+		t.Errorf("removed entry index = %d, want -1", entries[2].index)
+	}
+
+	var got []time.Duration
+	for queue.Len() > 0 {
+		entry := heap.Pop(&queue).(*scheduledObject)
+		got = append(got, entry.nextDue.Sub(testEpoch)/time.Second)
+	}
+	want := []time.Duration{0, 5, 5, 10, 30, 45}
+	if len(got) != len(want) {
+		t.Fatalf("popped %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("popped %v, want %v", got, want)
+		}
+	}
+}
+
+func TestSpreadOffset(t *testing.T) {
+	tests := []struct {
+		key      objectKey
+		interval time.Duration
+	}{
+		{objectKey{1, 1}, 10 * time.Second},
+		{objectKey{1, 2}, 10 * time.Second},
+		{objectKey{-3, 4000000000}, time.Minute},
+		{objectKey{2, 1}, time.Nanosecond},
+		{objectKey{2, 1}, 0},
+	}
+	for _, tt := range tests {
+		offset := spreadOffset(tt.key, tt.interval)
+		if offset < 0 || (tt.interval > 0 && offset >= tt.interval) || (tt.interval == 0 && offset != 0) {
+			t.Errorf("spreadOffset(%v, %s) = %s, want within the interval", tt.key, tt.interval, offset)
+		}
+		if again := spreadOffset(tt.key, tt.interval); again != offset {
+			t.Errorf("spreadOffset(%v, %s) = %s then %s, want stable", tt.key, tt.interval, offset, again)
+		}
+	}
+}
+
+func TestFirstReportSlot(t *testing.T) {
+	previousEpoch := simulationEpoch
+	simulationEpoch = testEpoch
+	defer func() { simulationEpoch = previousEpoch }()
+
+	key := objectKey{1, 7}
+	interval := 10 * time.Second
+	offset := spreadOffset(key, interval)
+	tests := []struct {
+		name string
+		now  time.Time
+		want time.Time
+	}{
+		{"before the epoch", testEpoch.Add(-time.Hour), testEpoch.Add(offset)},
+		{"on the first slot", testEpoch.Add(offset), testEpoch.Add(offset)},
+		{"just after a slot", testEpoch.Add(offset + time.Nanosecond), testEpoch.Add(offset + interval)},
+		{"many intervals later", testEpoch.Add(offset + 95*time.Second), testEpoch.Add(offset + 100*time.Second)},
+	}
+	for _, tt := range tests {
+		if got := firstReportSlot(key, interval, tt.now); !got.Equal(tt.want) {
+			t.Errorf("%s: firstReportSlot = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReportSchedulerAddAndRemove(t *testing.T) {
+	previousEpoch := simulationEpoch
+	simulationEpoch = testEpoch
+	defer func() { simulationEpoch = previousEpoch }()
+
+	appConfig := AppConfig{Clock: NewManualClock(testEpoch), ReportWorkers: 1}
+	scheduler := appConfig.NewReportScheduler(nil)
+	ctx := context.Background()
+
+	add := func(controllerId int16, objectId uint32) *liveObject {
+		live := &liveObject{object: WiredDeviceObject{ControllerId: controllerId, ObjectId: objectId, ReportIntervalSeconds: 10}}
+		scheduler.Add(ctx, nil, live)
+		return live
+	}
+	add(1, 1)
+	add(1, 2)
+	add(2, 1)
+	// Adding an object again replaces its entry
+	add(1, 2)
+	if len(scheduler.entries) != 3 || scheduler.queue.Len() != 3 {
+		t.Fatalf("%d entries, %d queued, want 3 and 3", len(scheduler.entries), scheduler.queue.Len())
+	}
+
+	removed := scheduler.RemoveController(1)
+	if len(removed) != 2 {
+		t.Errorf("RemoveController returned %d objects, want 2", len(removed))
+	}
+	if len(scheduler.entries) != 1 || scheduler.queue.Len() != 1 {
+		t.Errorf("%d entries, %d queued after removal, want 1 and 1", len(scheduler.entries), scheduler.queue.Len())
+	}
+	if key := scheduler.queue[0].key; key != (objectKey{2, 1}) {
+		t.Errorf("remaining entry %v, want controller 2 object 1", key)
+	}
+}
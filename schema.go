@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+)
+
+// TagType describes how a tag's value bytes are laid out on the wire
+type TagType int8
+
+const (
+	TagTypeByte TagType = iota + 1
+	TagTypeInt
+	TagTypeFloat
+	TagTypeString
+	TagTypeBoolean
+	TagTypeUnsigned
+	TagTypeEnumerated
+	TagTypeDouble
+	TagTypeBitString
+	TagTypeDate
+	TagTypeTime
+	// TagTypeAny is used where the layout depends on another tag (e.g. the report value)
+	TagTypeAny
+)
+
+func (t TagType) String() string {
+	switch t {
+	case TagTypeByte:
+		return "byte"
+	case TagTypeInt:
+		return "int32"
+	case TagTypeFloat:
+		return "float(8)"
+	case TagTypeString:
+		return "string"
+	case TagTypeBoolean:
+		return "boolean"
+	case TagTypeUnsigned:
+		return "unsigned"
+	case TagTypeEnumerated:
+		return "enumerated"
+	case TagTypeDouble:
+		return "double"
+	case TagTypeBitString:
+		return "bitstring"
+	case TagTypeDate:
+		return "date"
+	case TagTypeTime:
+		return "time"
+	case TagTypeAny:
+		return "any"
+	}
+	return fmt.Sprintf("TagType(%d)", int8(t))
+}
+
+// size returns the fixed byte width of the type, or -1 when it is variable
+func (t TagType) size() int {
+	switch t {
+	case TagTypeByte, TagTypeBoolean:
+		return 1
+	case TagTypeInt, TagTypeUnsigned, TagTypeEnumerated, TagTypeDate, TagTypeTime:
+		return 4
+	case TagTypeFloat, TagTypeDouble:
+		return 8
+	}
+	return -1
+}
+
+// Command IDs. Only CommandReport matches the Java createRequestMessage() callers;
+// the downlink and ack ids 2-6 are assumptions until the server side defines them.
+const (
+	CommandReport        = 1
+	CommandWriteProperty = 2 // assumed
+	CommandConfigChange  = 3 // assumed
+	CommandTimeSync      = 4 // assumed
+	CommandReboot        = 5 // assumed
+	CommandAck           = 6 // assumed
+)
+
+// Tags of CommandReport
+const (
+	TagReportType     = 1
+	TagReportDataType = 2
+	TagReportValue    = 3
+	TagObjectId       = 4
+	TagTimestamp      = 5
+)
+
+// Tags of the downlink commands (write-property, config change, time sync), assumed like their ids
+const (
+	TagDownlinkObjectId = 1
+	TagDownlinkDataType = 2
+	TagDownlinkValue    = 3
+	TagDownlinkPriority = 4
+
+	TagConfigKey   = 2
+	TagConfigValue = 3
+
+	TagTimeSyncTimestamp = 1
+)
+
+// Tags of CommandAck, assumed like its id
+const (
+	TagAckCommandId     = 1
+	TagAckStatus        = 2
+	TagAckObjectId      = 3
+	TagAckDownlinkSeqId = 4
+	TagAckMessage       = 5
+)
+
+type TagSchema struct {
+	Tag      byte
+	Name     string
+	Type     TagType
+	Required bool
+}
+
+type CommandSchema struct {
+	CommandId byte
+	Name      string
+	Tags      []TagSchema
+}
+
+var (
+	ErrUnknownCommand = errors.New("schema: unknown command")
+	ErrUnknownTag     = errors.New("schema: unknown tag")
+	ErrDuplicateTag   = errors.New("schema: duplicate tag")
+	ErrMissingTag     = errors.New("schema: missing required tag")
+	ErrInvalidTagSize = errors.New("schema: invalid tag size")
+)
+
+var commandRegistry = map[byte]CommandSchema{}
+
+func init() {
+	RegisterCommand(CommandSchema{
+		CommandId: CommandReport,
+		Name:      "report",
+		Tags: []TagSchema{
+			{Tag: TagReportType, Name: "reportType", Type: TagTypeByte, Required: true},
+			{Tag: TagReportDataType, Name: "dataType", Type: TagTypeByte, Required: true},
+			{Tag: TagReportValue, Name: "value", Type: TagTypeAny, Required: false},
+			{Tag: TagObjectId, Name: "objectId", Type: TagTypeInt, Required: true},
+			{Tag: TagTimestamp, Name: "timestamp", Type: TagTypeInt, Required: true},
+		},
+	})
+	RegisterCommand(CommandSchema{
+		CommandId: CommandWriteProperty,
+		Name:      "writeProperty",
+		Tags: []TagSchema{
+			{Tag: TagDownlinkObjectId, Name: "objectId", Type: TagTypeInt, Required: true},
+			{Tag: TagDownlinkDataType, Name: "dataType", Type: TagTypeByte, Required: true},
+			{Tag: TagDownlinkValue, Name: "value", Type: TagTypeAny, Required: true},
+			{Tag: TagDownlinkPriority, Name: "priority", Type: TagTypeByte, Required: false},
+		},
+	})
+	RegisterCommand(CommandSchema{
+		CommandId: CommandConfigChange,
+		Name:      "configChange",
+		Tags: []TagSchema{
+			{Tag: TagDownlinkObjectId, Name: "objectId", Type: TagTypeInt, Required: true},
+			{Tag: TagConfigKey, Name: "key", Type: TagTypeString, Required: true},
+			{Tag: TagConfigValue, Name: "value", Type: TagTypeString, Required: true},
+		},
+	})
+	RegisterCommand(CommandSchema{
+		CommandId: CommandTimeSync,
+		Name:      "timeSync",
+		Tags: []TagSchema{
+			{Tag: TagTimeSyncTimestamp, Name: "timestamp", Type: TagTypeInt, Required: true},
+		},
+	})
+	RegisterCommand(CommandSchema{
+		CommandId: CommandReboot,
+		Name:      "reboot",
+	})
+	RegisterCommand(CommandSchema{
+		CommandId: CommandAck,
+		Name:      "ack",
+		Tags: []TagSchema{
+			{Tag: TagAckCommandId, Name: "commandId", Type: TagTypeByte, Required: true},
+			{Tag: TagAckStatus, Name: "status", Type: TagTypeByte, Required: true},
+			{Tag: TagAckObjectId, Name: "objectId", Type: TagTypeInt, Required: false},
+			{Tag: TagAckDownlinkSeqId, Name: "downlinkSeqId", Type: TagTypeInt, Required: false},
+			{Tag: TagAckMessage, Name: "message", Type: TagTypeString, Required: false},
+		},
+	})
+}
+
+// RegisterCommand adds or replaces the layout of a command
+func RegisterCommand(schema CommandSchema) {
+	commandRegistry[schema.CommandId] = schema
+}
+
+// LookupCommand returns the registered layout of a command
+func LookupCommand(commandId byte) (CommandSchema, bool) {
+	schema, ok := commandRegistry[commandId]
+	return schema, ok
+}
+
+func (c CommandSchema) tag(tag byte) (TagSchema, bool) {
+	for _, ts := range c.Tags {
+		if ts.Tag == tag {
+			return ts, true
+		}
+	}
+	return TagSchema{}, false
+}
+
+// Validate checks the message against the registered layout of its command
+func (t *TagVO) Validate() error {
+	schema, ok := LookupCommand(t.CommandId)
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrUnknownCommand, t.CommandId)
+	}
+
+	seen := make(map[byte]bool, len(t.message))
+	for _, tv := range t.message {
+		ts, ok := schema.tag(tv.Tag)
+		if !ok {
+			return fmt.Errorf("%w: %d in command %s", ErrUnknownTag, tv.Tag, schema.Name)
+		}
+		if seen[tv.Tag] {
+			return fmt.Errorf("%w: %s in command %s", ErrDuplicateTag, ts.Name, schema.Name)
+		}
+		seen[tv.Tag] = true
+
+		if size := ts.Type.size(); size >= 0 && len(tv.Value) != size {
+			return fmt.Errorf("%w: %s is %s, got %d bytes", ErrInvalidTagSize, ts.Name, ts.Type, len(tv.Value))
+		}
+	}
+
+	for _, ts := range schema.Tags {
+		if ts.Required && !seen[ts.Tag] {
+			return fmt.Errorf("%w: %s in command %s", ErrMissingTag, ts.Name, schema.Name)
+		}
+	}
+	return nil
+}
+
+// WriteSchemaReference prints every registered command and its tags as a table
+func WriteSchemaReference(out io.Writer) error {
+	ids := make([]int, 0, len(commandRegistry))
+	for id := range commandRegistry {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CMD\tCOMMAND\tTAG\tFIELD\tTYPE\tREQUIRED")
+	for _, id := range ids {
+		schema := commandRegistry[byte(id)]
+		if len(schema.Tags) == 0 {
+			fmt.Fprintf(w, "%d\t%s\t-\t-\t-\t-\n", schema.CommandId, schema.Name)
+		}
+		for _, ts := range schema.Tags {
+			required := "no"
+			if ts.Required {
+				required = "yes"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\t%s\n", schema.CommandId, schema.Name, ts.Tag, ts.Name, ts.Type, required)
+		}
+	}
+	return w.Flush()
+}
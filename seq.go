@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// seqLock keeps increment-and-read of a controller's sequence atomic across goroutines
+var seqLock sync.Mutex
+
+// nextUplinkSeqId allocates and persists the next uplink sequence number of a controller
+func (appConfig AppConfig) nextUplinkSeqId(controller ControllerMaster, db *gorm.DB) (int64, error) {
+	seqLock.Lock()
+	defer seqLock.Unlock()
+
+	var seqId int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&ControllerMaster{}).Where("id = ?", controller.Id).
+			UpdateColumn("uplink_seq_id", gorm.Expr("uplink_seq_id + 1")).Error; err != nil {
+			return err
+		}
+		return tx.Model(&ControllerMaster{}).Where("id = ?", controller.Id).Select("uplink_seq_id").Scan(&seqId).Error
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to allocate uplink sequence for %s: %w", controller.MacAddress, err)
+	}
+	return seqId, nil
+}
+
+// currentUplinkSeqId returns the last sequence number allocated for a controller
+func (appConfig AppConfig) currentUplinkSeqId(controller ControllerMaster, db *gorm.DB) int64 {
+	var seqId int64
+	if err := db.Model(&ControllerMaster{}).Where("id = ?", controller.Id).Select("uplink_seq_id").Scan(&seqId).Error; err != nil {
+		log.WithError(err).WithField("controller", controller.MacAddress).Error("Failed to read uplink sequence")
+		return -1
+	}
+	return seqId
+}
+
+// parseUplinkAck extracts the acknowledged sequence number from a from-controller response, if any
+func parseUplinkAck(resBody []byte) (int64, bool) {
+	var parsed map[string]interface{}
+	if err := json.Unmarshal(resBody, &parsed); err != nil {
+		return 0, false
+	}
+	if success, ok := parsed["success"].(map[string]interface{}); ok {
+		if data, ok := success["data"].(map[string]interface{}); ok {
+			if seqId, ok := data["uplinkSeqId"].(float64); ok {
+				return int64(seqId), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// checkUplinkAck records the server's acknowledgement of the sequence that was sent and
+// reports whether it covers it. Kept uplinks the acknowledgement covers are released.
+// A lower ack means the server is missing earlier uplinks: the kept ones after the
+// acknowledged seqId are queued for replay, and this one is kept until it is covered too.
+func (appConfig AppConfig) checkUplinkAck(controller ControllerMaster, seqId int64, resBody []byte, db *gorm.DB) bool {
+	ackId, ok := parseUplinkAck(resBody)
+	if !ok {
+		// Server did not echo a sequence, accept the 2xx as delivery
+		ackId = seqId
+	}
+
+	fields := logrus.Fields{"controller": controller.MacAddress, "uplinkSeqId": seqId, "ackSeqId": ackId}
+	if ackId > seqId {
+		log.WithFields(fields).Warn("Server already had this uplink, treating as duplicate")
+	}
+
+	if err := db.Model(&ControllerMaster{}).Where("id = ? AND acked_uplink_seq_id < ?", controller.Id, ackId).
+		UpdateColumn("acked_uplink_seq_id", ackId).Error; err != nil {
+		log.WithError(err).WithFields(fields).Error("Failed to record uplink ack")
+	}
+	appConfig.releaseAckedUplinks(controller, ackId, db)
+
+	if ackId < seqId {
+		fields["replayed"] = appConfig.replayUplinkGap(controller, ackId, seqId, db)
+		log.WithFields(fields).Warn("Server acknowledged an older uplink, replaying the kept uplinks in between")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestCheckUplinkAck(t *testing.T) {
+	db := newTestDB(t)
+	controller := ControllerMaster{Id: 1, ControllerId: 1, MacAddress: "00:11:22:33:44:55"}
+	tests := []struct {
+		name    string
+		seqId   int64
+		resBody string
+		want    bool
+	}{
+		{"echoed", 5, `{"success":{"data":{"uplinkSeqId":5}}}`, true},
+		{"no echo", 5, `{"success":{"data":{}}}`, true},
+		{"not json", 5, `OK`, true},
+		{"duplicate", 5, `{"success":{"data":{"uplinkSeqId":7}}}`, true},
+		{"gap", 5, `{"success":{"data":{"uplinkSeqId":3}}}`, false},
+	}
+	for _, tt := range tests {
+		if got := (AppConfig{}).checkUplinkAck(controller, tt.seqId, []byte(tt.resBody), db); got != tt.want {
+			t.Errorf("%s: checkUplinkAck = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -4,13 +4,14 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"math"
 )
 
 type TagValue struct {
-	Tag    byte
-	Length uint16
-	Value  []byte
+	Tag   byte
+	Value []byte
 }
 
 type TagVO struct {
@@ -22,9 +23,8 @@ type TagVO struct {
 func (t *TagVO) AddByteValue(tag int, value byte) {
 	val := []byte{value}
 	t.message = append(t.message, TagValue{
-		Tag:    byte(tag),
-		Length: uint16(len(val)),
-		Value:  val,
+		Tag:   byte(tag),
+		Value: val,
 	})
 }
 
@@ -33,9 +33,8 @@ func (t *TagVO) AddIntValue(tag int, value int32) {
 	buf := new(bytes.Buffer)
 	binary.Write(buf, binary.BigEndian, value)
 	t.message = append(t.message, TagValue{
-		Tag:    byte(tag),
-		Length: 4,
-		Value:  buf.Bytes(),
+		Tag:   byte(tag),
+		Value: buf.Bytes(),
 	})
 }
 
@@ -45,9 +44,8 @@ func (t *TagVO) AddFloatValue(tag int, value float32) {
 	binary.BigEndian.PutUint32(buf[:4], math.Float32bits(value))
 	// remaining 4 bytes stay zero, matching Java ByteBuffer.allocate(8).putFloat()
 	t.message = append(t.message, TagValue{
-		Tag:    byte(tag),
-		Length: 8,
-		Value:  buf,
+		Tag:   byte(tag),
+		Value: buf,
 	})
 }
 
@@ -55,24 +53,113 @@ func (t *TagVO) AddFloatValue(tag int, value float32) {
 func (t *TagVO) AddStringValue(tag int, value string) {
 	val := []byte(value)
 	t.message = append(t.message, TagValue{
-		Tag:    byte(tag),
-		Length: uint16(len(val)),
-		Value:  val,
+		Tag:   byte(tag),
+		Value: val,
 	})
 }
 
+var (
+	ErrTagNotFound     = errors.New("tlv: tag not found")
+	ErrTagTypeMismatch = errors.New("tlv: tag type mismatch")
+)
+
+// Tags returns the tag numbers in the order they appear in the message
+func (t *TagVO) Tags() []byte {
+	tags := make([]byte, 0, len(t.message))
+	for _, tv := range t.message {
+		tags = append(tags, tv.Tag)
+	}
+	return tags
+}
+
+// Values returns a copy of the TLV segments in message order
+func (t *TagVO) Values() []TagValue {
+	values := make([]TagValue, len(t.message))
+	copy(values, t.message)
+	return values
+}
+
+// Lookup returns the first segment carrying the given tag
+func (t *TagVO) Lookup(tag int) (TagValue, bool) {
+	for _, tv := range t.message {
+		if tv.Tag == byte(tag) {
+			return tv, true
+		}
+	}
+	return TagValue{}, false
+}
+
+// lookupSized finds a tag and checks it has the byte width its accessor expects
+func (t *TagVO) lookupSized(tag int, size int, kind string) ([]byte, error) {
+	tv, ok := t.Lookup(tag)
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrTagNotFound, tag)
+	}
+	if len(tv.Value) != size {
+		return nil, fmt.Errorf("%w: tag %d has %d bytes, %s needs %d", ErrTagTypeMismatch, tag, len(tv.Value), kind, size)
+	}
+	return tv.Value, nil
+}
+
+// Get a 1-byte value
+func (t *TagVO) GetByteValue(tag int) (byte, error) {
+	val, err := t.lookupSized(tag, 1, "byte")
+	if err != nil {
+		return 0, err
+	}
+	return val[0], nil
+}
+
+// Get a 4-byte int value (BigEndian)
+func (t *TagVO) GetIntValue(tag int) (int32, error) {
+	val, err := t.lookupSized(tag, 4, "int")
+	if err != nil {
+		return 0, err
+	}
+	return int32(binary.BigEndian.Uint32(val)), nil
+}
+
+// Get an 8-byte float value, reading the float from the first 4 bytes like Java's getFloat()
+func (t *TagVO) GetFloatValue(tag int) (float32, error) {
+	val, err := t.lookupSized(tag, 8, "float")
+	if err != nil {
+		return 0, err
+	}
+	return math.Float32frombits(binary.BigEndian.Uint32(val[:4])), nil
+}
+
+// Get a string (raw bytes)
+func (t *TagVO) GetStringValue(tag int) (string, error) {
+	tv, ok := t.Lookup(tag)
+	if !ok {
+		return "", fmt.Errorf("%w: %d", ErrTagNotFound, tag)
+	}
+	return string(tv.Value), nil
+}
+
 // CreateRequestMessage — builds the same packet as Java’s createRequestMessage()
-func (t *TagVO) CreateRequestMessage() []byte {
+// Lengths are 16-bit on the wire, so oversized values or messages are rejected instead of wrapping.
+func (t *TagVO) CreateRequestMessage() ([]byte, error) {
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+
 	var messageBuf bytes.Buffer
 
 	// Build TLV segments
 	for _, tv := range t.message {
+		if len(tv.Value) > math.MaxUint16 {
+			return nil, fmt.Errorf("%w: tag %d has %d bytes, max %d", ErrValueTooLong, tv.Tag, len(tv.Value), math.MaxUint16)
+		}
 		messageBuf.WriteByte(tv.Tag)
-		binary.Write(&messageBuf, binary.BigEndian, tv.Length)
+		binary.Write(&messageBuf, binary.BigEndian, uint16(len(tv.Value)))
 		messageBuf.Write(tv.Value)
 	}
 
 	messageBytes := messageBuf.Bytes()
+	if len(messageBytes) > math.MaxUint16 {
+		return nil, fmt.Errorf("%w: %d bytes, max %d", ErrMessageTooLong, len(messageBytes), math.MaxUint16)
+	}
 
 	// Total length (2 bytes)
 	totalLen := uint16(len(messageBytes))
@@ -92,10 +179,123 @@ func (t *TagVO) CreateRequestMessage() []byte {
 	// Write TLVs
 	finalBuf.Write(messageBytes)
 
-	return finalBuf.Bytes()
+	return finalBuf.Bytes(), nil
+}
+
+const (
+	frameHeaderLen = 6
+	tlvHeaderLen   = 3
+)
+
+var (
+	ErrValueTooLong   = errors.New("tlv: value exceeds 16-bit length")
+	ErrMessageTooLong = errors.New("tlv: message exceeds 16-bit length")
+	ErrInvalidHeader  = errors.New("tlv: invalid frame header")
+	ErrFrameTruncated = errors.New("tlv: frame truncated")
+	ErrFrameOversized = errors.New("tlv: frame oversized")
+)
+
+// ParseRequestMessage decodes a packet built by CreateRequestMessage back into a TagVO
+func ParseRequestMessage(frame []byte) (*TagVO, error) {
+	t, err := decodeRequestMessage(frame)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// decodeRequestMessage checks the framing only, so the caller can still answer a
+// well-formed frame whose command or tags are not in the schema
+func decodeRequestMessage(frame []byte) (*TagVO, error) {
+	if len(frame) < frameHeaderLen {
+		return nil, fmt.Errorf("%w: got %d bytes, need at least %d", ErrFrameTruncated, len(frame), frameHeaderLen)
+	}
+
+	// Fixed header [1][1][1]
+	if frame[0] != 1 || frame[1] != 1 || frame[2] != 1 {
+		return nil, fmt.Errorf("%w: % x", ErrInvalidHeader, frame[:3])
+	}
+
+	t := &TagVO{CommandId: frame[3]}
+
+	// Total message length must match the bytes that follow the header exactly
+	totalLen := int(binary.BigEndian.Uint16(frame[4:6]))
+	body := frame[frameHeaderLen:]
+	if len(body) < totalLen {
+		return nil, fmt.Errorf("%w: header declares %d bytes, got %d", ErrFrameTruncated, totalLen, len(body))
+	}
+	if len(body) > totalLen {
+		return nil, fmt.Errorf("%w: header declares %d bytes, got %d", ErrFrameOversized, totalLen, len(body))
+	}
+
+	// Walk the TLV segments
+	for offset := 0; offset < len(body); {
+		if len(body)-offset < tlvHeaderLen {
+			return nil, fmt.Errorf("%w: incomplete tag header at offset %d", ErrFrameTruncated, frameHeaderLen+offset)
+		}
+		tag := body[offset]
+		length := binary.BigEndian.Uint16(body[offset+1 : offset+3])
+		offset += tlvHeaderLen
+
+		if len(body)-offset < int(length) {
+			return nil, fmt.Errorf("%w: tag %d declares %d bytes, only %d left", ErrFrameTruncated, tag, length, len(body)-offset)
+		}
+		value := make([]byte, length)
+		copy(value, body[offset:offset+int(length)])
+		offset += int(length)
+
+		t.message = append(t.message, TagValue{
+			Tag:   tag,
+			Value: value,
+		})
+	}
+	return t, nil
+}
+
+// ParseRequestMessages splits a buffer of back-to-back frames, as sent in a batched uplink
+func ParseRequestMessages(data []byte) ([]*TagVO, error) {
+	frames, err := decodeRequestMessages(data)
+	if err != nil {
+		return nil, err
+	}
+	for i, frame := range frames {
+		if err := frame.Validate(); err != nil {
+			return nil, fmt.Errorf("frame %d: %w", i, err)
+		}
+	}
+	return frames, nil
+}
+
+// decodeRequestMessages splits back-to-back frames without validating them against
+// the schema. On a framing error it returns the frames before the broken one.
+func decodeRequestMessages(data []byte) ([]*TagVO, error) {
+	var frames []*TagVO
+	for offset := 0; offset < len(data); {
+		if len(data)-offset < frameHeaderLen {
+			return frames, fmt.Errorf("%w: %d trailing bytes at offset %d", ErrFrameTruncated, len(data)-offset, offset)
+		}
+		end := offset + frameHeaderLen + int(binary.BigEndian.Uint16(data[offset+4:offset+6]))
+		if end > len(data) {
+			end = len(data)
+		}
+		frame, err := decodeRequestMessage(data[offset:end])
+		if err != nil {
+			return frames, fmt.Errorf("frame at offset %d: %w", offset, err)
+		}
+		frames = append(frames, frame)
+		offset = end
+	}
+	return frames, nil
 }
 
 // Hex dump for debugging
-func (t *TagVO) HexDump() string {
-	return hex.EncodeToString(t.CreateRequestMessage())
+func (t *TagVO) HexDump() (string, error) {
+	frame, err := t.CreateRequestMessage()
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(frame), nil
 }
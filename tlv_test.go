@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func reportVO(objectId int32, value float32) *TagVO {
+	t := &TagVO{CommandId: CommandReport}
+	t.AddByteValue(TagReportType, 2)
+	t.AddByteValue(TagReportDataType, 4)
+	t.AddFloatValue(TagReportValue, value)
+	t.AddIntValue(TagObjectId, objectId)
+	t.AddIntValue(TagTimestamp, int32(testEpoch.Unix()))
+	return t
+}
+
+func TestCreateRequestMessageRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		vo   *TagVO
+	}{
+		{"report", reportVO(42, 21.5)},
+		{"report without value", func() *TagVO {
+			t := &TagVO{CommandId: CommandReport}
+			t.AddByteValue(TagReportType, 2)
+			t.AddByteValue(TagReportDataType, 0)
+			t.AddIntValue(TagObjectId, 1)
+			t.AddIntValue(TagTimestamp, 0)
+			return t
+		}()},
+		{"ack with message", func() *TagVO {
+			t := &TagVO{CommandId: CommandAck}
+			t.AddByteValue(TagAckCommandId, CommandWriteProperty)
+			t.AddByteValue(TagAckStatus, AckStatusFailed)
+			t.AddStringValue(TagAckMessage, "object not found")
+			return t
+		}()},
+		{"reboot without tags", &TagVO{CommandId: CommandReboot}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame, err := tt.vo.CreateRequestMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := ParseRequestMessage(frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsed.CommandId != tt.vo.CommandId {
+				t.Errorf("CommandId = %d, want %d", parsed.CommandId, tt.vo.CommandId)
+			}
+			want, got := tt.vo.Values(), parsed.Values()
+			if len(got) != len(want) {
+				t.Fatalf("got %d tags, want %d", len(got), len(want))
+			}
+			for i := range want {
+				if got[i].Tag != want[i].Tag || !bytes.Equal(got[i].Value, want[i].Value) {
+					t.Errorf("tag %d = %d % x, want %d % x", i, got[i].Tag, got[i].Value, want[i].Tag, want[i].Value)
+				}
+			}
+			again, err := parsed.CreateRequestMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(again, frame) {
+				t.Errorf("re-encoded frame % x, want % x", again, frame)
+			}
+		})
+	}
+}
+
+func TestReportFrameAccessors(t *testing.T) {
+	frame, err := reportVO(42, 21.5).CreateRequestMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseRequestMessage(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := parsed.GetFloatValue(TagReportValue); err != nil || value != 21.5 {
+		t.Errorf("GetFloatValue = %v, %v, want 21.5", value, err)
+	}
+	if objectId, err := parsed.GetIntValue(TagObjectId); err != nil || objectId != 42 {
+		t.Errorf("GetIntValue = %v, %v, want 42", objectId, err)
+	}
+	if timestamp, err := parsed.GetIntValue(TagTimestamp); err != nil || !time.Unix(int64(timestamp), 0).Equal(testEpoch) {
+		t.Errorf("timestamp = %v, %v, want %s", timestamp, err, testEpoch)
+	}
+	if _, err := parsed.GetIntValue(TagReportType); !errors.Is(err, ErrTagTypeMismatch) {
+		t.Errorf("GetIntValue of a byte tag: err = %v, want %v", err, ErrTagTypeMismatch)
+	}
+	if _, err := parsed.GetByteValue(9); !errors.Is(err, ErrTagNotFound) {
+		t.Errorf("GetByteValue of a missing tag: err = %v, want %v", err, ErrTagNotFound)
+	}
+}
+
+func TestParseRequestMessageErrors(t *testing.T) {
+	valid, err := reportVO(42, 21.5).CreateRequestMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		frame []byte
+		want  error
+	}{
+		{"empty", nil, ErrFrameTruncated},
+		{"truncated header", valid[:5], ErrFrameTruncated},
+		{"invalid header", append([]byte{1, 2, 1}, valid[3:]...), ErrInvalidHeader},
+		{"truncated body", valid[:len(valid)-1], ErrFrameTruncated},
+		{"oversized body", append(append([]byte(nil), valid...), 0), ErrFrameOversized},
+		{"truncated tag header", []byte{1, 1, 1, CommandReport, 0, 2, TagReportType, 0}, ErrFrameTruncated},
+		{"truncated tag value", []byte{1, 1, 1, CommandReport, 0, 4, TagReportType, 0, 2, 2}, ErrFrameTruncated},
+		{"unknown command", []byte{1, 1, 1, 9, 0, 0}, ErrUnknownCommand},
+		{"unknown tag", []byte{1, 1, 1, CommandReboot, 0, 4, 7, 0, 1, 0}, ErrUnknownTag},
+		{"missing tag", []byte{1, 1, 1, CommandTimeSync, 0, 0}, ErrMissingTag},
+		{"wrong tag size", []byte{1, 1, 1, CommandTimeSync, 0, 4, TagTimeSyncTimestamp, 0, 1, 0}, ErrInvalidTagSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseRequestMessage(tt.frame); !errors.Is(err, tt.want) {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateRequestMessageTooLong(t *testing.T) {
+	tests := []struct {
+		name  string
+		value int
+		want  error
+	}{
+		{"value over 16 bits", 1 << 16, ErrValueTooLong},
+		{"message over 16 bits", 1<<16 - 10, ErrMessageTooLong},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ack := &TagVO{CommandId: CommandAck}
+			ack.AddByteValue(TagAckCommandId, CommandReport)
+			ack.AddByteValue(TagAckStatus, AckStatusOk)
+			ack.AddStringValue(TagAckMessage, string(make([]byte, tt.value)))
+			if _, err := ack.CreateRequestMessage(); !errors.Is(err, tt.want) {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRequestMessages(t *testing.T) {
+	first, _ := reportVO(1, 1).CreateRequestMessage()
+	second, _ := reportVO(2, 2).CreateRequestMessage()
+	reboot, _ := (&TagVO{CommandId: CommandReboot}).CreateRequestMessage()
+	unknown := []byte{1, 1, 1, 9, 0, 0}
+
+	join := func(frames ...[]byte) []byte { return bytes.Join(frames, nil) }
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []byte // command ids of the frames
+		wantErr error
+	}{
+		{"empty", nil, nil, nil},
+		{"single", first, []byte{CommandReport}, nil},
+		{"back to back", join(first, reboot, second), []byte{CommandReport, CommandReboot, CommandReport}, nil},
+		{"trailing bytes", join(first, []byte{1, 1, 1}), nil, ErrFrameTruncated},
+		{"truncated last frame", join(first, second[:len(second)-2]), nil, ErrFrameTruncated},
+		{"unknown command", join(first, unknown), nil, ErrUnknownCommand},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frames, err := ParseRequestMessages(tt.data)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if len(frames) != len(tt.want) {
+				t.Fatalf("got %d frames, want %d", len(frames), len(tt.want))
+			}
+			for i, frame := range frames {
+				if frame.CommandId != tt.want[i] {
+					t.Errorf("frame %d CommandId = %d, want %d", i, frame.CommandId, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeRequestMessages(t *testing.T) {
+	first, _ := reportVO(1, 1).CreateRequestMessage()
+	unknown := []byte{1, 1, 1, 9, 0, 0}
+
+	// Frames the schema rejects still decode, so downlinks can ack them
+	frames, err := decodeRequestMessages(bytes.Join([][]byte{unknown, first}, nil))
+	if err != nil || len(frames) != 2 || frames[0].CommandId != 9 {
+		t.Fatalf("decodeRequestMessages = %d frames, %v, want the unknown command and the report", len(frames), err)
+	}
+	if err := frames[0].Validate(); !errors.Is(err, ErrUnknownCommand) {
+		t.Errorf("Validate = %v, want %v", err, ErrUnknownCommand)
+	}
+
+	// A framing error keeps the frames before it
+	frames, err = decodeRequestMessages(bytes.Join([][]byte{first, {1, 1}}, nil))
+	if !errors.Is(err, ErrFrameTruncated) || len(frames) != 1 {
+		t.Errorf("decodeRequestMessages = %d frames, %v, want 1 frame and %v", len(frames), err, ErrFrameTruncated)
+	}
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"math/rand/v2"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -27,6 +30,31 @@ type WiredDeviceObject struct {
 	ReportSentAt     time.Time `json:"reportSentAt"`
 	ReportType       int8      `json:"reportType"`
 	ReportValue      float32   `json:"reportValue"`
+	// 0 falls back to the rule's interval
+	ReportIntervalSeconds int32 `json:"reportIntervalSeconds"`
+	// Zero values fall back to the rule's COV settings
+	ReportMode           int8    `json:"reportMode"`
+	CovIncrement         float32 `json:"covIncrement"`
+	CovMaxSilenceSeconds int32   `json:"covMaxSilenceSeconds"`
+	// Set on derived objects, whose value is computed from other objects instead of generated
+	Expression string `gorm:"type:text" json:"expression"`
+	// Full-precision value behind ReportValue, so long-running counters do not lose float32 precision
+	AccumulatedValue float64 `json:"accumulatedValue"`
+}
+
+// preciseValue is AccumulatedValue, unless ReportValue has been set on its own since,
+// e.g. by a write-property downlink or a row that predates AccumulatedValue
+func (object WiredDeviceObject) preciseValue() float64 {
+	if float32(object.AccumulatedValue) == object.ReportValue {
+		return object.AccumulatedValue
+	}
+	return float64(object.ReportValue)
+}
+
+// setValue stores a generated value at full precision and as the float32 report value
+func (object *WiredDeviceObject) setValue(value float64) {
+	object.AccumulatedValue = value
+	object.ReportValue = float32(value)
 }
 
 type WiredObjectRules struct {
@@ -37,6 +65,24 @@ type WiredObjectRules struct {
 	ParamId      int16   `json:"paramId"`
 	ParamName    string  `json:"paramName"`
 	IsContinuous bool    `json:"isContinuous"`
+	// Largest change per tick for non-continuous rules, 0 means 5% of the min-max range
+	MaxStep float32 `json:"maxStep"`
+	// Empty keeps the IsContinuous/min-max behaviour, see NewValueGenerator
+	GeneratorType   string `gorm:"size:32" json:"generatorType"`
+	GeneratorParams string `gorm:"type:text" json:"generatorParams"`
+	// Optional LoadProfile shaping the generator by time of day and day type
+	LoadProfileId uint16 `json:"loadProfileId"`
+	// 0 falls back to defaultReportInterval
+	ReportIntervalSeconds int32 `json:"reportIntervalSeconds"`
+	// 0 means periodic reporting
+	ReportMode           int8    `json:"reportMode"`
+	CovIncrement         float32 `json:"covIncrement"`
+	CovMaxSilenceSeconds int32   `json:"covMaxSilenceSeconds"`
+	// Continuous rules only: the meter wraps to 0 on reaching RolloverLimit, e.g. 1000000
+	// for a 999999.9 register or 4294967296 for 32 bits (0 never wraps), and each tick
+	// resets to 0 with ResetProbability, like a meter swap or power loss
+	RolloverLimit    float64 `json:"rolloverLimit"`
+	ResetProbability float64 `json:"resetProbability"`
 }
 
 const (
@@ -44,10 +90,177 @@ const (
 	INTEGER
 	FLOAT
 	STRING
+	BOOLEAN
+	UNSIGNED
+	ENUMERATED
+	DOUBLE
+	BITSTRING
+	DATE
+	TIME
 )
 
+// bacnetApplicationTag maps a ReportDataType to the BACnet datatype sent in TAG 2.
+// The original four types have always been reported as REAL and keep doing so.
+func bacnetApplicationTag(reportDataType int8) byte {
+	switch reportDataType {
+	case BOOLEAN:
+		return BacnetBoolean
+	case UNSIGNED:
+		return BacnetUnsigned
+	case ENUMERATED:
+		return BacnetEnumerated
+	case DOUBLE:
+		return BacnetDouble
+	case BITSTRING:
+		return BacnetBitString
+	case DATE:
+		return BacnetDate
+	case TIME:
+		return BacnetTime
+	}
+	return BacnetReal
+}
+
 var objectRulesMap = make(map[int16]WiredObjectRules)
 
+// Report modes; in COV mode values are still generated every interval but
+// only sent when they move by CovIncrement (any change when it is 0) or the
+// max silence has passed
+const (
+	ReportModePeriodic = iota + 1
+	ReportModeCov
+)
+
+// max silence of a COV object when neither object nor rule set one
+const defaultCovMaxSilence = 15 * time.Minute
+
+// covSettings resolves the COV configuration of an object, the object's own values winning over its rule's
+func covSettings(object WiredDeviceObject) (enabled bool, increment float32, maxSilence time.Duration) {
+	rule := objectRulesMap[object.IqnextObjectType]
+
+	mode := object.ReportMode
+	if mode == 0 {
+		mode = rule.ReportMode
+	}
+	if mode != ReportModeCov {
+		return false, 0, 0
+	}
+
+	increment = object.CovIncrement
+	if increment <= 0 {
+		increment = rule.CovIncrement
+	}
+	maxSilence = defaultCovMaxSilence
+	if object.CovMaxSilenceSeconds > 0 {
+		maxSilence = time.Duration(object.CovMaxSilenceSeconds) * time.Second
+	} else if rule.CovMaxSilenceSeconds > 0 {
+		maxSilence = time.Duration(rule.CovMaxSilenceSeconds) * time.Second
+	}
+	return true, increment, maxSilence
+}
+
+// reportInterval resolves how often an object reports: its own interval, then its rule's, then the default
+func reportInterval(object WiredDeviceObject) time.Duration {
+	if object.ReportIntervalSeconds > 0 {
+		return time.Duration(object.ReportIntervalSeconds) * time.Second
+	}
+	if rule, ok := objectRulesMap[object.IqnextObjectType]; ok && rule.ReportIntervalSeconds > 0 {
+		return time.Duration(rule.ReportIntervalSeconds) * time.Second
+	}
+	return defaultReportInterval
+}
+
+// liveObject is the in-memory state of an object whose reports are being generated.
+// Downlink handlers change it under mu so the report loop picks the change up.
+type liveObject struct {
+	mu     sync.Mutex
+	object WiredDeviceObject
+	rng    *rand.Rand
+
+	// last report actually queued, for COV decisions
+	hasSent       bool
+	lastSentValue float32
+	lastSentAt    time.Time
+
+	// fault injection state, see fault.go
+	faults    map[uint32]*faultState
+	heldFrame []byte
+}
+
+// shouldReport applies the object's report mode to a freshly generated value; call with mu held
+func (live *liveObject) shouldReport(now time.Time) bool {
+	enabled, increment, maxSilence := covSettings(live.object)
+	if !enabled || !live.hasSent {
+		return true
+	}
+	change := live.object.ReportValue - live.lastSentValue
+	if change < 0 {
+		change = -change
+	}
+	if increment <= 0 {
+		return change > 0 || now.Sub(live.lastSentAt) >= maxSilence
+	}
+	return change >= increment || now.Sub(live.lastSentAt) >= maxSilence
+}
+
+// markReported records the value that was just queued; call with mu held
+func (live *liveObject) markReported(now time.Time) {
+	live.hasSent = true
+	live.lastSentValue = live.object.ReportValue
+	live.lastSentAt = now
+}
+
+// advance generates the object's value at timeNow and reports whether it should be sent
+func (live *liveObject) advance(timeNow time.Time) (WiredDeviceObject, bool) {
+	live.mu.Lock()
+	defer live.mu.Unlock()
+
+	object := live.object
+	object.setValue(generatorFor(object.IqnextObjectType).Next(GeneratorTick{
+		DeviceId:  object.DeviceId,
+		ObjectId:  object.ObjectId,
+		Now:       timeNow,
+		Interval:  reportInterval(object),
+		LastValue: object.preciseValue(),
+		Weight:    profileWeight(objectRulesMap[object.IqnextObjectType], timeNow),
+		Rand:      live.rng,
+	}))
+	live.object = object
+	sendReport := live.shouldReport(timeNow)
+	if sendReport {
+		live.markReported(timeNow)
+	}
+	return object, sendReport
+}
+
+type objectKey struct {
+	ControllerId int16
+	ObjectId     uint32
+}
+
+var liveObjects sync.Map
+
+func trackLiveObject(object WiredDeviceObject) *liveObject {
+	live := &liveObject{object: object, rng: objectRand(object.ControllerId, object.ObjectId)}
+	liveObjects.Store(objectKey{object.ControllerId, object.ObjectId}, live)
+	return live
+}
+
+func untrackLiveObject(live *liveObject) {
+	live.mu.Lock()
+	key := objectKey{live.object.ControllerId, live.object.ObjectId}
+	live.mu.Unlock()
+	liveObjects.CompareAndDelete(key, live)
+}
+
+func findLiveObject(controllerId int16, objectId uint32) (*liveObject, bool) {
+	live, ok := liveObjects.Load(objectKey{controllerId, objectId})
+	if !ok {
+		return nil, false
+	}
+	return live.(*liveObject), true
+}
+
 func (appConfig AppConfig) LoadObjectRules(db *gorm.DB) {
 	var objectRulesList []WiredObjectRules
 	result := db.Find(&objectRulesList)
@@ -63,120 +276,239 @@ func (appConfig AppConfig) LoadObjectRules(db *gorm.DB) {
 
 		for _, rule := range objectRulesList {
 			objectRulesMap[rule.ParamId] = rule
+
+			generator, err := NewValueGenerator(rule)
+			if err != nil {
+				log.WithError(err).WithField("paramName", rule.ParamName).Error("Invalid generator, holding last value")
+				generator = holdGenerator{}
+			}
+			generatorsByRule[rule.ParamId] = generator
 		}
 		log.Info("Rules Loaded to cache successfully")
 	}
 }
 
-func (appConfig AppConfig) StartReportGenerationForController(controller ControllerMaster, db *gorm.DB) {
+// StartReportGenerationForController schedules the objects of a controller and starts its batcher.
+// Reports keep firing until ctx is cancelled; done is closed once reports already
+// handed to the pool have finished and the last batch and outbox have been flushed.
+func (appConfig AppConfig) StartReportGenerationForController(ctx context.Context, scheduler *ReportScheduler, controller ControllerMaster, db *gorm.DB) (batcher *ReportBatcher, done <-chan struct{}, err error) {
 	var wiredDeviceObjectList []WiredDeviceObject
 	result := db.Where("controller_id = ?", controller.ControllerId).Find(&wiredDeviceObjectList)
 	if result.Error != nil {
-		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			log.Warn("No controllers found in database")
-		} else {
-			log.WithError(result.Error).Error("Failed to fetch controllers")
+		if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, nil, fmt.Errorf("failed to fetch wired device objects: %w", result.Error)
 		}
-		return
+		log.Warn("No wired device objects found in database")
 	}
 	log.WithFields(logrus.Fields{"count": len(wiredDeviceObjectList), "controller": controller.MacAddress}).Info("Retrieved wired device objects for controller: ")
+
+	// All objects of the controller share one uplink per batch window
+	batcher = appConfig.NewReportBatcher(controller, db)
+
+	lives := make(map[objectKey]*liveObject, len(wiredDeviceObjectList))
+	hasDerived := false
 	for _, object := range wiredDeviceObjectList {
-		objectCopy := object // Create a copy to avoid closure issues
-		log.Info("Starting to generate report for : " + objectCopy.ObjectName)
-		go appConfig.startSendingReportForObject(controller.Token, objectCopy, db)
+		lives[objectKey{object.ControllerId, object.ObjectId}] = trackLiveObject(object)
+		hasDerived = hasDerived || object.Expression != ""
+	}
+	graph := &derivedGraph{}
+	if hasDerived {
+		graph = buildDerivedGraph(wiredDeviceObjectList, lives)
+		derivedGraphs.Store(int16(controller.ControllerId), graph)
 	}
-}
 
-func (appConfig AppConfig) startSendingReportForObject(token string, object WiredDeviceObject, db *gorm.DB) {
-	lastValue := object.ReportValue
-	for {
-		objectRule := objectRulesMap[object.IqnextObjectType]
-		if objectRule.IsContinuous {
-			// take the last value add the constant and send
-			if objectRule.Constant == 0.0 {
-				// get a random value between 1
-				objectRule.Constant = rand.Float32()
-			}
-			object.ReportValue = lastValue + objectRule.Constant
-			lastValue = object.ReportValue
-			log.WithFields(logrus.Fields{"ObjectName": object.ObjectName, "objectValue": lastValue}).Info("Generated value")
+	// Derived objects left out of the graph hold their value and are not scheduled
+	var heldLives []*liveObject
+	for _, object := range wiredDeviceObjectList {
+		key := objectKey{object.ControllerId, object.ObjectId}
+		if _, ok := graph.objects[key]; object.Expression != "" && !ok {
+			heldLives = append(heldLives, lives[key])
+			continue
+		}
+		log.Info("Starting to generate report for : " + object.ObjectName)
+		scheduler.Add(ctx, batcher, lives[key])
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		batcher.Run(ctx)
+
+		for _, live := range scheduler.RemoveController(int16(controller.ControllerId)) {
+			appConfig.stopObject(live, db)
 		}
-		// else {
-		// 	// Generate a value between max and min
-		// 	minVal := objectRule.MinValue
-		// 	maxVal := objectRule.MaxValue
-		// 	randomValue := minVal + rand.Float32()*(maxVal-minVal)
-		// 	object.ReportValue = randomValue
-		// 	lastValue = object.ReportValue
-		// 	log.WithFields(logrus.Fields{
-		// 		"ObjectName":  object.ObjectName,
-		// 		"objectValue": randomValue,
-		// 		"minValue":    minVal,
-		// 		"maxValue":    maxVal,
-		// 	}).Info("Generated random value between min-max")
-		// }
-		// / Update the object in database
-		appConfig.sendReportToController(token, object, 1)
-		if err := db.Save(&object); err.Error != nil {
-			log.WithError(err.Error).Error("Failed to save object report value")
+		derivedGraphs.Delete(int16(controller.ControllerId))
+		for _, live := range heldLives {
+			appConfig.stopObject(live, db)
+		}
+		appConfig.drainController(batcher, db)
+	}()
+	return batcher, stopped, nil
+}
+
+// drainController sends whatever is still batched and makes a last attempt at the outbox
+func (appConfig AppConfig) drainController(batcher *ReportBatcher, db *gorm.DB) {
+	controller := batcher.Controller()
+	if err := batcher.Flush(); err != nil {
+		log.WithError(err).WithField("controller", controller.MacAddress).Warn("Final report batch not delivered, kept in outbox")
+	}
+	if appConfig.hasOutboxBacklog(controller, db) {
+		if err := appConfig.flushOutbox(controller, db); err != nil {
+			log.WithError(err).WithField("controller", controller.MacAddress).Warn("Outbox not fully flushed before stop")
 		}
-		//sleep for 10 sec
-		time.Sleep(30 * time.Second)
 	}
+	log.WithField("controller", controller.MacAddress).Info("Controller worker stopped")
 }
 
-func (appConfig AppConfig) sendReportToController(token string, object WiredDeviceObject, reportFor int) error {
-	data := &TagVO{CommandId: 1}
+// stopObject persists the last value of an object and stops tracking it. Runs with a
+// fixed seed keep the stored row; downlink changes were already saved by updateObject.
+func (appConfig AppConfig) stopObject(live *liveObject, db *gorm.DB) {
+	defer untrackLiveObject(live)
+	if !appConfig.savesGeneratedValues() {
+		return
+	}
+	live.mu.Lock()
+	object := live.object
+	live.mu.Unlock()
+	if err := db.Save(&object).Error; err != nil {
+		log.WithError(err).WithField("ObjectName", object.ObjectName).Error("Failed to save object on stop")
+	}
+}
+
+// generateReportForObject produces the value of an object for its report slot due and queues its report.
+// Using the slot rather than the moment a worker picks it up keeps seeded runs reproducible.
+func (appConfig AppConfig) generateReportForObject(batcher *ReportBatcher, live *liveObject, due time.Time, db *gorm.DB) {
+	timeNow := controllerTime(batcher.Controller(), due)
+
+	live.mu.Lock()
+	key := objectKey{live.object.ControllerId, live.object.ObjectId}
+	live.mu.Unlock()
+	if graph, derived, ok := findDerivedObject(key); ok {
+		appConfig.evaluateDerived(batcher, graph, derived, timeNow, db)
+		return
+	}
+
+	object, sendReport := live.advance(timeNow)
+	log.WithFields(logrus.Fields{"ObjectName": object.ObjectName, "objectValue": object.ReportValue}).Info("Generated value")
+
+	if sendReport {
+		queueReport(batcher, live, object, timeNow)
+	} else {
+		log.WithField("ObjectName", object.ObjectName).Debug("Value within COV increment, report suppressed")
+	}
+
+	// / Update the object in database
+	if !appConfig.savesGeneratedValues() {
+		return
+	}
+	if err := db.Save(&object); err.Error != nil {
+		log.WithError(err.Error).Error("Failed to save object report value")
+	}
+}
+
+// buildReportFrame encodes the report TLV frame for an object at the given time
+func buildReportFrame(object WiredDeviceObject, timeNow time.Time) ([]byte, error) {
+	data := &TagVO{CommandId: CommandReport}
 
 	// TAG 1: Bacnet report type
-	data.AddByteValue(1, 2)
+	data.AddByteValue(TagReportType, 2)
 
 	// TAG 2: Report value datatype
-	data.AddByteValue(2, 4)
+	data.AddByteValue(TagReportDataType, bacnetApplicationTag(object.ReportDataType))
 
 	// TAG 3: Report Value
 	if object.ReportDataType != 0 {
 		switch object.ReportDataType {
 		case BYTE:
-			data.AddByteValue(3, byte(object.ReportValue))
+			data.AddByteValue(TagReportValue, byte(object.ReportValue))
 		case INTEGER:
-			data.AddIntValue(3, int32(object.ReportValue))
+			data.AddIntValue(TagReportValue, int32(object.preciseValue()))
 		case FLOAT:
-			data.AddFloatValue(3, object.ReportValue)
+			data.AddFloatValue(TagReportValue, object.ReportValue)
 		case STRING:
-			data.AddStringValue(3, fmt.Sprintf("%.2f", object.ReportValue))
+			data.AddStringValue(TagReportValue, fmt.Sprintf("%.2f", object.preciseValue()))
+		case BOOLEAN:
+			data.AddBooleanValue(TagReportValue, object.ReportValue != 0)
+		case UNSIGNED:
+			data.AddUnsignedValue(TagReportValue, uint32(max(object.preciseValue(), 0)))
+		case ENUMERATED:
+			data.AddEnumeratedValue(TagReportValue, uint32(max(object.ReportValue, 0)))
+		case DOUBLE:
+			data.AddDoubleValue(TagReportValue, object.preciseValue())
+		case BITSTRING:
+			data.AddBitStringValue(TagReportValue, statusFlags(uint32(max(object.ReportValue, 0))))
+		case DATE:
+			data.AddDateValue(TagReportValue, timeNow)
+		case TIME:
+			data.AddTimeValue(TagReportValue, timeNow)
 		}
 	}
 
 	// TAG 4: objectId
-	data.AddIntValue(4, int32(object.ObjectId))
+	data.AddIntValue(TagObjectId, int32(object.ObjectId))
 
 	// TAG 5: timestamp
-	data.AddIntValue(5, int32(time.Now().Unix()))
+	data.AddIntValue(TagTimestamp, int32(timeNow.Unix()))
+
+	reportData, err := data.CreateRequestMessage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode report for object %d: %w", object.ObjectId, err)
+	}
+	return reportData, nil
+}
 
-	reportData := data.CreateRequestMessage()
+// ErrRateLimited is what sendUplink errors wrap when the server answers 429
+var ErrRateLimited = errors.New("rate limited by server")
 
+// rateLimitError carries the server's Retry-After, zero when it sent none
+type rateLimitError struct {
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("%v, retry after %s", ErrRateLimited, e.retryAfter)
+}
+
+func (e *rateLimitError) Unwrap() error { return ErrRateLimited }
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(raw string) time.Duration {
+	if seconds, err := strconv.Atoi(raw); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(raw); err == nil {
+		return max(time.Until(at), 0)
+	}
+	return 0
+}
+
+// sendUplink posts encoded frames to the from-controller endpoint, keyed by reportFor.
+// Any 2xx counts as delivered; acked is false when the server acknowledged an earlier
+// seqId, so the caller keeps the uplink until the acknowledgement catches up.
+func (appConfig AppConfig) sendUplink(controller ControllerMaster, seqId int64, dataFromController map[int][]byte, db *gorm.DB) (acked bool, err error) {
 	// Convert bytes to array of integers
-	intArray := make([]int, len(reportData))
-	for i, b := range reportData {
-		intArray[i] = int(b)
+	dataArray := make(map[int][]int, len(dataFromController))
+	for reportFor, reportData := range dataFromController {
+		intArray := make([]int, len(reportData))
+		for i, b := range reportData {
+			intArray[i] = int(b)
+		}
+		dataArray[reportFor] = intArray
 	}
 
-	log.Info(intArray)
+	log.Debug(dataArray)
 
-	// Create map where key = reportFor, value = byte array
-	dataArray := make(map[int][]int)
-	dataArray[reportFor] = intArray
+	bootGeneration, isRebooted := rebootStatus(controller)
 
 	payloadForm := map[string]interface{}{
-		"isRebooted":         false,
-		"uplinkSeqId":        -1,
+		"isRebooted":         isRebooted,
+		"uplinkSeqId":        seqId,
 		"dataFromController": dataArray,
 	}
 
 	body, err := json.Marshal(payloadForm)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %v", err)
+		return false, fmt.Errorf("failed to create request: %v", err)
 	}
 
 	log.Info("Sending payload: ", string(body))
@@ -186,22 +518,22 @@ func (appConfig AppConfig) sendReportToController(token string, object WiredDevi
 
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
 	if err != nil {
-		return fmt.Errorf("error: %v", err)
+		return false, fmt.Errorf("error: %v", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
-	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Authorization", "Bearer "+controller.Token)
 
 	res, err := GetHttpClient().Do(req)
 	if err != nil {
-		return fmt.Errorf("HTTP Error: %v", err)
+		return false, fmt.Errorf("HTTP Error: %v", err)
 	}
 	defer res.Body.Close()
 
 	log.Infof("Response status: %d", res.StatusCode)
 
 	if res.StatusCode == http.StatusUnauthorized {
-		return fmt.Errorf("gateway got logged out")
+		return false, fmt.Errorf("gateway got logged out")
 	}
 
 	resBody, err := io.ReadAll(res.Body)
@@ -210,5 +542,13 @@ func (appConfig AppConfig) sendReportToController(token string, object WiredDevi
 	}
 	log.WithField("response", string(resBody)).Info("Got the response")
 
-	return nil
+	if res.StatusCode == http.StatusTooManyRequests {
+		return false, &rateLimitError{retryAfter: parseRetryAfter(res.Header.Get("Retry-After"))}
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return false, fmt.Errorf("HTTP error: %d", res.StatusCode)
+	}
+	markSynced(controller, bootGeneration)
+
+	return appConfig.checkUplinkAck(controller, seqId, resBody, db), nil
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShouldReport(t *testing.T) {
+	previousRules := objectRulesMap
+	objectRulesMap = map[int16]WiredObjectRules{5: {ReportMode: ReportModeCov, CovIncrement: 2, CovMaxSilenceSeconds: 60}}
+	defer func() { objectRulesMap = previousRules }()
+
+	now := testEpoch.Add(time.Hour)
+	cov := func(increment float32, maxSilenceSeconds int32) WiredDeviceObject {
+		return WiredDeviceObject{ReportMode: ReportModeCov, CovIncrement: increment, CovMaxSilenceSeconds: maxSilenceSeconds}
+	}
+	tests := []struct {
+		name      string
+		object    WiredDeviceObject
+		hasSent   bool
+		lastValue float32
+		value     float32
+		silence   time.Duration
+		want      bool
+	}{
+		{"periodic always reports", WiredDeviceObject{ReportMode: ReportModePeriodic}, true, 10, 10, 0, true},
+		{"first cov report", cov(1, 0), false, 0, 10, 0, true},
+		{"change below the increment", cov(1, 0), true, 10, 10.5, time.Minute, false},
+		{"change of exactly the increment", cov(1, 0), true, 10, 11, time.Minute, true},
+		{"drop past the increment", cov(1, 0), true, 10, 8.5, time.Minute, true},
+		{"zero increment, unchanged", cov(0, 0), true, 10, 10, time.Minute, false},
+		{"zero increment, any change", cov(0, 0), true, 10, 10.001, time.Minute, true},
+		{"max silence not reached", cov(1, 120), true, 10, 10, 119 * time.Second, false},
+		{"max silence reached", cov(1, 120), true, 10, 10, 120 * time.Second, true},
+		{"zero increment, max silence reached", cov(0, 120), true, 10, 10, 120 * time.Second, true},
+		{"default max silence", cov(1, 0), true, 10, 10, defaultCovMaxSilence, true},
+		{"rule increment", WiredDeviceObject{IqnextObjectType: 5}, true, 10, 11.5, 0, false},
+		{"rule max silence", WiredDeviceObject{IqnextObjectType: 5}, true, 10, 10, time.Minute, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			live := &liveObject{object: tt.object, hasSent: tt.hasSent, lastSentValue: tt.lastValue, lastSentAt: now.Add(-tt.silence)}
+			live.object.ReportValue = tt.value
+			if got := live.shouldReport(now); got != tt.want {
+				t.Errorf("shouldReport() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}